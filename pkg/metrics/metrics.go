@@ -0,0 +1,104 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics exposes counters for the protocol layer via expvar, so
+// operators can diagnose throughput, loss, and stuck handshakes without
+// enabling trace logging.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Namespace is where every counter in this package is registered, mirroring
+// how DERP exposes its own metrics under a dedicated expvar.Map rather than
+// at the top level.
+var Namespace = expvar.NewMap("mieru/protocolv2")
+
+// Drop reasons reported through SegmentsDropped.
+const (
+	DropReasonQueueFull       = "queue-full"
+	DropReasonInvalidProtocol = "invalid-protocol"
+	// DropReasonDecryptFail is reported when a segment's AEAD seal fails
+	// to open, e.g. UDPUnderlay.ReadSegment rejecting a corrupted or
+	// forged datagram.
+	DropReasonDecryptFail   = "decrypt-fail"
+	DropReasonSessionClosed = "session-closed"
+)
+
+var (
+	InBytes  = newInt("InBytes")
+	OutBytes = newInt("OutBytes")
+
+	SegmentsSent          = newInt("SegmentsSent")
+	SegmentsReceived      = newInt("SegmentsReceived")
+	SegmentsRetransmitted = newInt("SegmentsRetransmitted")
+
+	// SegmentsDropped is broken down by reason, e.g.
+	// SegmentsDropped.Add(DropReasonQueueFull, 1).
+	SegmentsDropped = NewLabelMap("SegmentsDropped")
+
+	// SessionStateTransitions is broken down by the destination state's
+	// name, e.g. SessionStateTransitions.Add("sessionEstablished", 1).
+	SessionStateTransitions = NewLabelMap("SessionStateTransitions")
+)
+
+func newInt(name string) *expvar.Int {
+	v := new(expvar.Int)
+	Namespace.Set(name, v)
+	return v
+}
+
+// RegisterGauge publishes f's return value under name in Namespace,
+// re-evaluating it on every scrape. It's meant for values that are cheap
+// to compute on demand, such as a session's current buffer depth, rather
+// than counters that need to be incremented on the hot path.
+func RegisterGauge(name string, f func() any) {
+	Namespace.Set(name, expvar.Func(f))
+}
+
+// UnregisterGauge removes a gauge previously published with RegisterGauge.
+// Callers that register a gauge scoped to something shorter-lived than
+// the process, such as a Session, must call this when that thing goes
+// away, or Namespace accumulates one stale entry per instance forever.
+func UnregisterGauge(name string) {
+	Namespace.Delete(name)
+}
+
+// LabelMap is a counter broken down by a string label, such as a drop
+// reason or a session state name, modelled on DERP's packetsDroppedReason.
+type LabelMap struct {
+	m *expvar.Map
+}
+
+// NewLabelMap creates a LabelMap and registers it under Namespace.
+func NewLabelMap(name string) *LabelMap {
+	lm := &LabelMap{m: new(expvar.Map).Init()}
+	Namespace.Set(name, lm.m)
+	return lm
+}
+
+// Add increments the counter for label by delta, creating it if needed.
+func (l *LabelMap) Add(label string, delta int64) {
+	l.m.Add(label, delta)
+}
+
+// Handler serves every counter registered under Namespace, plus the rest
+// of the process's expvar.Vars, as JSON. It is meant to be mounted on a
+// debug endpoint, e.g. mux.Handle("/debug/vars", metrics.Handler()).
+func Handler() http.Handler {
+	return expvar.Handler()
+}
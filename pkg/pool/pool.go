@@ -0,0 +1,71 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package pool provides a sync.Pool-backed byte slice allocator with size
+// classes matching the buffer sizes mieru's protocol layer allocates most
+// often, so hot paths like per-segment fragment payloads reuse buffers
+// instead of allocating a fresh one on every Read or Write. Put still
+// allocates a small slice header for each buffer it returns to the pool.
+package pool
+
+import "sync"
+
+// sizeClasses lists the buffer sizes served by the pool, in ascending
+// order, chosen to cover typical MaxFragmentSize values over both TCP and
+// UDP underlays.
+var sizeClasses = []int{1280, 1500, 8192, 65536}
+
+var pools = newPools()
+
+func newPools() []sync.Pool {
+	p := make([]sync.Pool, len(sizeClasses))
+	for i, size := range sizeClasses {
+		size := size
+		p[i].New = func() any {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+	return p
+}
+
+// Get returns a byte slice of length n, backed by a pooled buffer from the
+// smallest size class that fits n. If n exceeds the largest size class,
+// Get falls back to a plain allocation that Put will silently ignore.
+func Get(n int) []byte {
+	for i, size := range sizeClasses {
+		if n <= size {
+			b := *(pools[i].Get().(*[]byte))
+			return b[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// Put returns a buffer previously obtained from Get back to its size
+// class's pool, so it can be reused. The buffer's capacity, not its
+// length, decides which pool it returns to. A buffer whose capacity
+// doesn't match a size class exactly - for example one grown by append -
+// is not a Get buffer anymore and is silently dropped.
+func Put(b []byte) {
+	c := cap(b)
+	for i, size := range sizeClasses {
+		if c == size {
+			full := b[:size]
+			pools[i].Put(&full)
+			return
+		}
+	}
+}
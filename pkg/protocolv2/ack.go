@@ -0,0 +1,102 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+// sackRange is a contiguous, inclusive range of sequence numbers that have
+// been received but are not yet contiguous with unAckSeq. It lets a peer
+// selectively retransmit only the segments that are actually missing,
+// instead of everything after the cumulative ack point.
+type sackRange struct {
+	left  uint32
+	right uint32
+}
+
+// maxSackRanges bounds the number of SACK ranges carried in a single ACK
+// segment so the encoded metadata stays well under one MTU.
+const maxSackRanges = 8
+
+// ackStruct is the metadata of a standalone ACK segment. Unlike
+// dataAckStruct, which piggybacks unAckSeq on outgoing data, ackStruct
+// carries no payload and is sent on its own when there is nothing to
+// piggyback it on, or when SACK information needs to reach the peer
+// before MaxAckDelay expires.
+type ackStruct struct {
+	baseStruct
+	sessionID  uint32
+	unAckSeq   uint32
+	windowSize uint16
+	sackRanges []sackRange
+}
+
+// dupSackThreshold is the number of times a hole must be reported by
+// incoming SACKs before every segment missing in the hole is fast
+// retransmitted, instead of waiting for its RTO to expire.
+const dupSackThreshold = 3
+
+// sackRangesIfEnabled returns buildSackRanges's result, or nil if the
+// channel-level handshake determined the peer doesn't support SACK.
+func (s *Session) sackRangesIfEnabled() []sackRange {
+	if !s.sackEnabled {
+		return nil
+	}
+	return s.buildSackRanges()
+}
+
+// buildSackRanges coalesces the out-of-order sequence numbers currently
+// held in recvBuf into a bounded list of SACK ranges, relative to
+// s.nextRecv.
+func (s *Session) buildSackRanges() []sackRange {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	if len(s.oooRecvSeq) == 0 {
+		return nil
+	}
+	seqs := make([]uint32, 0, len(s.oooRecvSeq))
+	for seq := range s.oooRecvSeq {
+		seqs = append(seqs, seq)
+	}
+	sortUint32(seqs)
+
+	ranges := make([]sackRange, 0, maxSackRanges)
+	start := seqs[0]
+	prev := seqs[0]
+	for _, seq := range seqs[1:] {
+		if seq == prev+1 {
+			prev = seq
+			continue
+		}
+		ranges = append(ranges, sackRange{left: start, right: prev})
+		start = seq
+		prev = seq
+		if len(ranges) == maxSackRanges {
+			return ranges
+		}
+	}
+	ranges = append(ranges, sackRange{left: start, right: prev})
+	return ranges
+}
+
+// sortUint32 is a small insertion sort. The number of outstanding
+// out-of-order sequence numbers is bounded by the receive window, so a
+// linear-ish sort is cheap and avoids pulling in sort.Slice for a handful
+// of elements.
+func sortUint32(s []uint32) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j-1] > s[j]; j-- {
+			s[j-1], s[j] = s[j], s[j-1]
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// SegmentCodec marshals a segment to and from its wire representation.
+// Splitting framing (SegmentChannel) from encoding (SegmentCodec) lets the
+// wire format evolve, or a new one be introduced, without touching
+// transport-specific code.
+type SegmentCodec interface {
+	Encode(seg *segment, w io.Writer) error
+	Decode(r io.Reader, seg *segment) error
+}
+
+// SegmentChannel reads and writes framed segments over some transport.
+// TCPUnderlay and UDPUnderlay are both expected to implement
+// SegmentChannel, so Session can drive either one without a
+// transport-specific type assertion.
+type SegmentChannel interface {
+	WriteSegment(ctx context.Context, seg *segment) error
+	ReadSegment(ctx context.Context, seg *segment) error
+	MTU() int
+	SetMTU(mtu int)
+}
+
+// channelVersion is the protocol version this build negotiates. Bump it
+// whenever the wire format changes in a way that requires both peers to
+// agree before data flows.
+const channelVersion = 2
+
+// channelCapability is a bit flag advertised during version negotiation.
+type channelCapability uint32
+
+const (
+	capSACK channelCapability = 1 << iota
+	capCipherAESGCM
+	capCipherChaCha20Poly1305
+)
+
+// versionHandshake is exchanged once, in each direction, before any
+// openSessionRequest crosses the channel. It lets client and server agree
+// on protocol version, MTU, and capabilities up front, analogous to 9p's
+// Tversion/Rversion exchange. It is a standalone handshake message, not a
+// segment, so it carries no session ID or sequence number.
+type versionHandshake struct {
+	version      uint32
+	mtu          uint32
+	capabilities channelCapability
+}
+
+// negotiateHandshake resolves what a client and a server each proposed
+// into the parameters both sides will use. It fails closed: if the two
+// sides don't share a protocol version, or don't agree on at least one
+// cipher suite, the channel can't be used. Of the cipher suites both
+// sides offer, negotiateHandshake keeps exactly one - AES-GCM is
+// preferred when both are available - so the result tells a caller
+// which single cipher to actually use, rather than leaving it to
+// rediscover that by re-ANDing the capability bits itself.
+func negotiateHandshake(local, remote versionHandshake) (versionHandshake, error) {
+	if local.version != remote.version {
+		return versionHandshake{}, fmt.Errorf("protocol version mismatch: local %d, remote %d", local.version, remote.version)
+	}
+	mtu := local.mtu
+	if remote.mtu < mtu {
+		mtu = remote.mtu
+	}
+	caps := local.capabilities & remote.capabilities
+	const cipherMask = capCipherAESGCM | capCipherChaCha20Poly1305
+	if caps&cipherMask == 0 {
+		return versionHandshake{}, fmt.Errorf("no common cipher suite: local %#x, remote %#x", local.capabilities, remote.capabilities)
+	}
+	cipher := capCipherAESGCM
+	if caps&capCipherAESGCM == 0 {
+		cipher = capCipherChaCha20Poly1305
+	}
+	return versionHandshake{
+		version:      local.version,
+		mtu:          mtu,
+		capabilities: (caps &^ cipherMask) | cipher,
+	}, nil
+}
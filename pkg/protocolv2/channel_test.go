@@ -0,0 +1,78 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import "testing"
+
+func TestNegotiateHandshakeVersionMismatch(t *testing.T) {
+	local := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherAESGCM}
+	remote := versionHandshake{version: channelVersion + 1, mtu: 1400, capabilities: capCipherAESGCM}
+	if _, err := negotiateHandshake(local, remote); err == nil {
+		t.Fatal("negotiateHandshake() should fail on version mismatch")
+	}
+}
+
+func TestNegotiateHandshakeNoCommonCipher(t *testing.T) {
+	local := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherAESGCM}
+	remote := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherChaCha20Poly1305}
+	if _, err := negotiateHandshake(local, remote); err == nil {
+		t.Fatal("negotiateHandshake() should fail when no cipher suite is shared")
+	}
+}
+
+func TestNegotiateHandshakeMTUTakesMin(t *testing.T) {
+	local := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherAESGCM}
+	remote := versionHandshake{version: channelVersion, mtu: 1280, capabilities: capCipherAESGCM}
+	got, err := negotiateHandshake(local, remote)
+	if err != nil {
+		t.Fatalf("negotiateHandshake() failed: %v", err)
+	}
+	if got.mtu != 1280 {
+		t.Errorf("mtu = %d, want 1280", got.mtu)
+	}
+}
+
+// TestNegotiateHandshakePrefersAESGCM would have caught negotiateHandshake
+// leaving both cipher bits set in its result, which left the negotiated
+// capability unconsulted by anything downstream.
+func TestNegotiateHandshakePrefersAESGCM(t *testing.T) {
+	local := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capSACK | capCipherAESGCM | capCipherChaCha20Poly1305}
+	remote := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capSACK | capCipherAESGCM | capCipherChaCha20Poly1305}
+	got, err := negotiateHandshake(local, remote)
+	if err != nil {
+		t.Fatalf("negotiateHandshake() failed: %v", err)
+	}
+	const cipherMask = capCipherAESGCM | capCipherChaCha20Poly1305
+	if got.capabilities&cipherMask != capCipherAESGCM {
+		t.Errorf("capabilities = %#x, want exactly capCipherAESGCM set", got.capabilities&cipherMask)
+	}
+	if got.capabilities&capSACK == 0 {
+		t.Error("capSACK should still be set after cipher resolution")
+	}
+}
+
+func TestNegotiateHandshakeFallsBackToChaCha(t *testing.T) {
+	local := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherAESGCM | capCipherChaCha20Poly1305}
+	remote := versionHandshake{version: channelVersion, mtu: 1400, capabilities: capCipherChaCha20Poly1305}
+	got, err := negotiateHandshake(local, remote)
+	if err != nil {
+		t.Fatalf("negotiateHandshake() failed: %v", err)
+	}
+	const cipherMask = capCipherAESGCM | capCipherChaCha20Poly1305
+	if got.capabilities&cipherMask != capCipherChaCha20Poly1305 {
+		t.Errorf("capabilities = %#x, want exactly capCipherChaCha20Poly1305 set", got.capabilities&cipherMask)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/enfein/mieru/pkg/pool"
+)
+
+// codecKind identifies which metadata struct follows a segment's header,
+// so Decode knows which concrete type to populate before handing the
+// segment to Session.
+type codecKind uint8
+
+const (
+	codecKindSession codecKind = iota
+	codecKindDataAck
+	codecKindAck
+)
+
+// defaultSegmentCodec is the SegmentCodec negotiated when the version
+// handshake doesn't pick anything else. It's a plain length-prefixed
+// encoding of the three metadata kinds this package defines, followed by
+// the segment's payload.
+type defaultSegmentCodec struct{}
+
+func (defaultSegmentCodec) Encode(seg *segment, w io.Writer) error {
+	switch meta := seg.metadata.(type) {
+	case *sessionStruct:
+		return encodeSessionStruct(meta, seg.payload, w)
+	case *dataAckStruct:
+		return encodeDataAckStruct(meta, seg.payload, w)
+	case *ackStruct:
+		return encodeAckStruct(meta, w)
+	default:
+		return fmt.Errorf("defaultSegmentCodec: unsupported metadata type %T", seg.metadata)
+	}
+}
+
+func (defaultSegmentCodec) Decode(r io.Reader, seg *segment) error {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return err
+	}
+	switch codecKind(kind[0]) {
+	case codecKindSession:
+		meta, payload, err := decodeSessionStruct(r)
+		if err != nil {
+			return err
+		}
+		seg.metadata = meta
+		seg.payload = payload
+		return nil
+	case codecKindDataAck:
+		meta, payload, err := decodeDataAckStruct(r)
+		if err != nil {
+			return err
+		}
+		seg.metadata = meta
+		seg.payload = payload
+		return nil
+	case codecKindAck:
+		meta, err := decodeAckStruct(r)
+		if err != nil {
+			return err
+		}
+		seg.metadata = meta
+		return nil
+	default:
+		return fmt.Errorf("defaultSegmentCodec: unknown codec kind %d", kind[0])
+	}
+}
+
+func encodeSessionStruct(m *sessionStruct, payload []byte, w io.Writer) error {
+	hdr := make([]byte, 1+1+4+4+1+2)
+	hdr[0] = byte(codecKindSession)
+	hdr[1] = m.protocol
+	binary.BigEndian.PutUint32(hdr[2:6], m.sessionID)
+	binary.BigEndian.PutUint32(hdr[6:10], m.seq)
+	hdr[10] = m.statusCode
+	binary.BigEndian.PutUint16(hdr[11:13], m.payloadLen)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func decodeSessionStruct(r io.Reader) (*sessionStruct, []byte, error) {
+	hdr := make([]byte, 1+4+4+1+2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	payloadLen := binary.BigEndian.Uint16(hdr[10:12])
+	payload, err := readPayload(r, int(payloadLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &sessionStruct{
+		baseStruct: baseStruct{protocol: hdr[0]},
+		sessionID:  binary.BigEndian.Uint32(hdr[1:5]),
+		seq:        binary.BigEndian.Uint32(hdr[5:9]),
+		statusCode: hdr[9],
+		payloadLen: payloadLen,
+	}
+	return m, payload, nil
+}
+
+func encodeDataAckStruct(m *dataAckStruct, payload []byte, w io.Writer) error {
+	hdr := make([]byte, 1+1+4+4+4+2+1+2)
+	hdr[0] = byte(codecKindDataAck)
+	hdr[1] = m.protocol
+	binary.BigEndian.PutUint32(hdr[2:6], m.sessionID)
+	binary.BigEndian.PutUint32(hdr[6:10], m.seq)
+	binary.BigEndian.PutUint32(hdr[10:14], m.unAckSeq)
+	binary.BigEndian.PutUint16(hdr[14:16], m.windowSize)
+	hdr[16] = m.fragment
+	binary.BigEndian.PutUint16(hdr[17:19], m.payloadLen)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func decodeDataAckStruct(r io.Reader) (*dataAckStruct, []byte, error) {
+	hdr := make([]byte, 1+4+4+4+2+1+2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	payloadLen := binary.BigEndian.Uint16(hdr[16:18])
+	payload, err := readPayload(r, int(payloadLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &dataAckStruct{
+		baseStruct: baseStruct{protocol: hdr[0]},
+		sessionID:  binary.BigEndian.Uint32(hdr[1:5]),
+		seq:        binary.BigEndian.Uint32(hdr[5:9]),
+		unAckSeq:   binary.BigEndian.Uint32(hdr[9:13]),
+		windowSize: binary.BigEndian.Uint16(hdr[13:15]),
+		fragment:   hdr[15],
+		payloadLen: payloadLen,
+	}
+	return m, payload, nil
+}
+
+func encodeAckStruct(m *ackStruct, w io.Writer) error {
+	hdr := make([]byte, 1+1+4+4+2+1)
+	hdr[0] = byte(codecKindAck)
+	hdr[1] = m.protocol
+	binary.BigEndian.PutUint32(hdr[2:6], m.sessionID)
+	binary.BigEndian.PutUint32(hdr[6:10], m.unAckSeq)
+	binary.BigEndian.PutUint16(hdr[10:12], m.windowSize)
+	hdr[12] = uint8(len(m.sackRanges))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	ranges := make([]byte, 8*len(m.sackRanges))
+	for i, r := range m.sackRanges {
+		binary.BigEndian.PutUint32(ranges[i*8:i*8+4], r.left)
+		binary.BigEndian.PutUint32(ranges[i*8+4:i*8+8], r.right)
+	}
+	_, err := w.Write(ranges)
+	return err
+}
+
+func decodeAckStruct(r io.Reader) (*ackStruct, error) {
+	hdr := make([]byte, 1+4+4+2+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := int(hdr[11])
+	ranges := make([]byte, 8*n)
+	if n > 0 {
+		if _, err := io.ReadFull(r, ranges); err != nil {
+			return nil, err
+		}
+	}
+	sackRanges := make([]sackRange, n)
+	for i := 0; i < n; i++ {
+		sackRanges[i] = sackRange{
+			left:  binary.BigEndian.Uint32(ranges[i*8 : i*8+4]),
+			right: binary.BigEndian.Uint32(ranges[i*8+4 : i*8+8]),
+		}
+	}
+	return &ackStruct{
+		baseStruct: baseStruct{protocol: hdr[0]},
+		sessionID:  binary.BigEndian.Uint32(hdr[1:5]),
+		unAckSeq:   binary.BigEndian.Uint32(hdr[5:9]),
+		windowSize: binary.BigEndian.Uint16(hdr[9:11]),
+		sackRanges: sackRanges,
+	}, nil
+}
+
+func readPayload(r io.Reader, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	b := pool.Get(n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		pool.Put(b)
+		return nil, err
+	}
+	return b, nil
+}
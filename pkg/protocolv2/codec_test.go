@@ -0,0 +1,142 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestDefaultSegmentCodecSessionStructRoundTrip would have caught the
+// decodeSessionStruct off-by-one: hdr was sized to exclude the kind byte
+// Decode already consumed, but payloadLen was still read at the encode
+// side's offset for it.
+func TestDefaultSegmentCodecSessionStructRoundTrip(t *testing.T) {
+	payload := []byte("open session payload")
+	want := &segment{
+		metadata: &sessionStruct{
+			baseStruct: baseStruct{protocol: openSessionRequest},
+			sessionID:  0x01020304,
+			seq:        42,
+			statusCode: 7,
+			payloadLen: uint16(len(payload)),
+		},
+		payload: payload,
+	}
+
+	var buf bytes.Buffer
+	var codec defaultSegmentCodec
+	if err := codec.Encode(want, &buf); err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+
+	var got segment
+	if err := codec.Decode(&buf, &got); err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	gotMeta, ok := got.metadata.(*sessionStruct)
+	if !ok {
+		t.Fatalf("Decode() produced metadata of type %T, want *sessionStruct", got.metadata)
+	}
+	wantMeta := want.metadata.(*sessionStruct)
+	if *gotMeta != *wantMeta {
+		t.Errorf("Decode() metadata = %+v, want %+v", gotMeta, wantMeta)
+	}
+	if !bytes.Equal(got.payload, payload) {
+		t.Errorf("Decode() payload = %q, want %q", got.payload, payload)
+	}
+}
+
+// TestDefaultSegmentCodecDataAckStructRoundTrip would have caught the
+// decodeDataAckStruct off-by-one in its payloadLen offset.
+func TestDefaultSegmentCodecDataAckStructRoundTrip(t *testing.T) {
+	payload := []byte("some fragment of data")
+	want := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{protocol: dataClientToServer},
+			sessionID:  0x0a0b0c0d,
+			seq:        1000,
+			unAckSeq:   990,
+			windowSize: 4096,
+			fragment:   3,
+			payloadLen: uint16(len(payload)),
+		},
+		payload: payload,
+	}
+
+	var buf bytes.Buffer
+	var codec defaultSegmentCodec
+	if err := codec.Encode(want, &buf); err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+
+	var got segment
+	if err := codec.Decode(&buf, &got); err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	gotMeta, ok := got.metadata.(*dataAckStruct)
+	if !ok {
+		t.Fatalf("Decode() produced metadata of type %T, want *dataAckStruct", got.metadata)
+	}
+	wantMeta := want.metadata.(*dataAckStruct)
+	if *gotMeta != *wantMeta {
+		t.Errorf("Decode() metadata = %+v, want %+v", gotMeta, wantMeta)
+	}
+	if !bytes.Equal(got.payload, payload) {
+		t.Errorf("Decode() payload = %q, want %q", got.payload, payload)
+	}
+}
+
+// TestDefaultSegmentCodecAckStructRoundTrip would have caught the
+// decodeAckStruct off-by-one: n := int(hdr[12]) indexed one past the end
+// of a 12-byte hdr.
+func TestDefaultSegmentCodecAckStructRoundTrip(t *testing.T) {
+	want := &segment{
+		metadata: &ackStruct{
+			baseStruct: baseStruct{protocol: ackServerToClient},
+			sessionID:  0x11223344,
+			unAckSeq:   55,
+			windowSize: 128,
+			sackRanges: []sackRange{
+				{left: 60, right: 62},
+				{left: 70, right: 70},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	var codec defaultSegmentCodec
+	if err := codec.Encode(want, &buf); err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+
+	var got segment
+	if err := codec.Decode(&buf, &got); err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	gotMeta, ok := got.metadata.(*ackStruct)
+	if !ok {
+		t.Fatalf("Decode() produced metadata of type %T, want *ackStruct", got.metadata)
+	}
+	wantMeta := want.metadata.(*ackStruct)
+	if gotMeta.sessionID != wantMeta.sessionID || gotMeta.unAckSeq != wantMeta.unAckSeq || gotMeta.windowSize != wantMeta.windowSize {
+		t.Errorf("Decode() metadata = %+v, want %+v", gotMeta, wantMeta)
+	}
+	if !reflect.DeepEqual(gotMeta.sackRanges, wantMeta.sackRanges) {
+		t.Errorf("Decode() sackRanges = %+v, want %+v", gotMeta.sackRanges, wantMeta.sackRanges)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// deadlineSignal is a reusable, updatable substitute for a context built
+// once with context.WithDeadline: net.Conn requires SetReadDeadline and
+// SetWriteDeadline to affect a call that is already blocked, not just
+// calls started afterward, which a context captured at the start of Read
+// or Write can't do. Modeled on the unexported pipeDeadline type behind
+// net.Pipe.
+type deadlineSignal struct {
+	mu    sync.Mutex
+	t     time.Time
+	timer *time.Timer
+	c     chan struct{}
+}
+
+func newDeadlineSignal() *deadlineSignal {
+	return &deadlineSignal{c: make(chan struct{})}
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// set updates the deadline to t. A t already in the past closes the
+// current channel immediately, waking every caller blocked on it right
+// now; a zero t clears the deadline. Either way, the next blocking call
+// picks up the change just as one already in flight does.
+func (d *deadlineSignal) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.c
+	}
+	d.timer = nil
+	closed := isClosedChan(d.c)
+	if t.IsZero() {
+		if closed {
+			d.c = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.c = make(chan struct{})
+		}
+		c := d.c
+		d.timer = time.AfterFunc(dur, func() { close(c) })
+		return
+	}
+	if !closed {
+		close(d.c)
+	}
+}
+
+// channel returns the channel that closes once the deadline expires. Each
+// call returns whatever is current, so a caller that re-reads it after a
+// Set call sees the up to date channel even if the previous one already
+// fired and was replaced.
+func (d *deadlineSignal) channel() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.c
+}
+
+func (d *deadlineSignal) deadline() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+// deadlineContext adapts a deadlineSignal to context.Context, so Read and
+// Write can hand it to the blocking segmentTree operations and have a
+// Set*Deadline call made mid-block actually interrupt them, instead of
+// only affecting the next call.
+type deadlineContext struct {
+	d *deadlineSignal
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) {
+	t := c.d.deadline()
+	return t, !t.IsZero()
+}
+
+func (c deadlineContext) Done() <-chan struct{} {
+	return c.d.channel()
+}
+
+func (c deadlineContext) Err() error {
+	select {
+	case <-c.d.channel():
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+func (c deadlineContext) Value(key any) any { return nil }
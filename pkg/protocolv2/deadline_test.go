@@ -0,0 +1,89 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReadDeadlineInterruptsAlreadyBlockedRead would have caught Read
+// capturing a plain context.WithDeadline at call time: such a context
+// can't change once Read is already blocked inside
+// recvQueue.DeleteMinBlockingCtx, so a SetReadDeadline call made from
+// another goroutine while Read is in flight would never wake it up.
+func TestReadDeadlineInterruptsAlreadyBlockedRead(t *testing.T) {
+	s, _ := newTestUDPSession(t)
+	s.forwardStateTo(sessionOpening)
+	s.forwardStateTo(sessionEstablished)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 64))
+		errc <- err
+	}()
+
+	// Give Read a moment to actually block on recvQueue, which never gets
+	// a segment in this test, before the deadline is set.
+	time.Sleep(20 * time.Millisecond)
+	s.SetReadDeadline(time.Now())
+
+	select {
+	case err := <-errc:
+		nerr, ok := err.(net.Error)
+		if !ok || !nerr.Timeout() {
+			t.Fatalf("Read() returned %v, want a net.Error with Timeout() == true", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() did not return after SetReadDeadline interrupted it")
+	}
+}
+
+// TestWriteDeadlineInterruptsAlreadyBlockedWrite is the Write-side
+// counterpart: sendQueue never drains in this test (there's no
+// runOutputLoop running), so Write blocks until SetWriteDeadline
+// interrupts it.
+func TestWriteDeadlineInterruptsAlreadyBlockedWrite(t *testing.T) {
+	s, _ := newTestUDPSession(t)
+	s.forwardStateTo(sessionOpening)
+	s.forwardStateTo(sessionEstablished)
+
+	// Fill sendQueue to capacity so the next Write has to block inside
+	// InsertBlockingCtx instead of completing immediately.
+	for i := 0; i < segmentTreeCapacity; i++ {
+		s.sendQueue.InsertBlocking(dataSegment(uint32(i)))
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("more data than sendQueue has room for"))
+		errc <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	s.SetWriteDeadline(time.Now())
+
+	select {
+	case err := <-errc:
+		nerr, ok := err.(net.Error)
+		if !ok || !nerr.Timeout() {
+			t.Fatalf("Write() returned %v, want a net.Error with Timeout() == true", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write() did not return after SetWriteDeadline interrupted it")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+)
+
+// segmentTree is a bounded collection of segments ordered by sequence
+// number, blocking inserts while full and deletes while empty. Every
+// buffer a Session keeps - sendQueue, sendBuf, recvBuf, and recvQueue - is
+// one of these, so a segment can always be located and removed by
+// sequence number regardless of which buffer it's currently sitting in.
+type segmentTree struct {
+	mu       sync.Mutex
+	notEmpty sync.Cond
+	notFull  sync.Cond
+	capacity int
+	items    segmentHeap
+	closed   bool
+}
+
+// newSegmentTree creates an empty segmentTree that blocks inserts once it
+// holds capacity segments.
+func newSegmentTree(capacity int) *segmentTree {
+	t := &segmentTree{capacity: capacity}
+	t.notEmpty.L = &t.mu
+	t.notFull.L = &t.mu
+	return t
+}
+
+// segmentHeap is a container/heap.Interface ordering segments by sequence
+// number. A segment whose Seq() fails is ordered last rather than
+// rejected outright, since by the time it reaches a segmentTree its
+// metadata has already been validated by the caller.
+type segmentHeap []*segment
+
+func (h segmentHeap) Len() int { return len(h) }
+
+func (h segmentHeap) Less(i, j int) bool {
+	si, erri := h[i].Seq()
+	sj, errj := h[j].Seq()
+	if erri != nil {
+		return false
+	}
+	if errj != nil {
+		return true
+	}
+	return si < sj
+}
+
+func (h segmentHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *segmentHeap) Push(x any) { *h = append(*h, x.(*segment)) }
+
+func (h *segmentHeap) Pop() any {
+	old := *h
+	n := len(old)
+	seg := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return seg
+}
+
+// Close wakes every blocked caller. Once closed, inserts and deletes
+// never block again: inserts fail immediately and deletes drain whatever
+// remains before also failing.
+func (t *segmentTree) Close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.notEmpty.Broadcast()
+	t.notFull.Broadcast()
+}
+
+// Len returns the number of segments currently held.
+func (t *segmentTree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.items.Len()
+}
+
+// Remaining returns how many more segments may be inserted before the
+// tree is at capacity.
+func (t *segmentTree) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.capacity - t.items.Len()
+}
+
+// InsertBlocking inserts seg, blocking while the tree is at capacity.
+func (t *segmentTree) InsertBlocking(seg *segment) {
+	t.InsertBlockingCtx(context.Background(), seg)
+}
+
+// InsertBlockingCtx inserts seg, blocking while the tree is at capacity
+// until ctx is done or the tree is closed. It returns false without
+// inserting if ctx expired or the tree was closed first.
+func (t *segmentTree) InsertBlockingCtx(ctx context.Context, seg *segment) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.items.Len() >= t.capacity && !t.closed && ctx.Err() == nil {
+		t.waitCtx(ctx, &t.notFull)
+	}
+	if t.closed || ctx.Err() != nil {
+		return false
+	}
+	heap.Push(&t.items, seg)
+	t.notEmpty.Broadcast()
+	return true
+}
+
+// DeleteMin removes and returns the segment with the smallest sequence
+// number, without blocking. ok is false if the tree is currently empty.
+func (t *segmentTree) DeleteMin() (seg *segment, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.items.Len() == 0 {
+		return nil, false
+	}
+	return heap.Pop(&t.items).(*segment), true
+}
+
+// DeleteMinBlocking removes and returns the segment with the smallest
+// sequence number, blocking until one is available or the tree is closed.
+func (t *segmentTree) DeleteMinBlocking() (*segment, bool) {
+	return t.DeleteMinBlockingCtx(context.Background())
+}
+
+// DeleteMinBlockingCtx removes and returns the segment with the smallest
+// sequence number, blocking until one is available, ctx is done, or the
+// tree is closed.
+func (t *segmentTree) DeleteMinBlockingCtx(ctx context.Context) (*segment, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.items.Len() == 0 && !t.closed && ctx.Err() == nil {
+		t.waitCtx(ctx, &t.notEmpty)
+	}
+	if t.items.Len() == 0 {
+		return nil, false
+	}
+	seg := heap.Pop(&t.items).(*segment)
+	t.notFull.Broadcast()
+	return seg, true
+}
+
+// DeleteMinIf removes and returns the smallest segment if pred returns
+// true for it, without blocking. It's used to drain everything up to some
+// threshold, e.g. every acked sequence number below unAckSeq.
+func (t *segmentTree) DeleteMinIf(pred func(*segment) bool) (*segment, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.items.Len() == 0 || !pred(t.items[0]) {
+		return nil, false
+	}
+	seg := heap.Pop(&t.items).(*segment)
+	t.notFull.Broadcast()
+	return seg, true
+}
+
+// Get returns the segment with the given sequence number, if present,
+// without removing it. It's used by fast retransmit to fetch a specific
+// segment out of sendBuf by sequence number.
+func (t *segmentTree) Get(seq uint32) (*segment, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, seg := range t.items {
+		if s, err := seg.Seq(); err == nil && s == seq {
+			return seg, true
+		}
+	}
+	return nil, false
+}
+
+// Delete removes and returns the segment with the given sequence number,
+// if present, without blocking. Unlike DeleteMinIf, which only ever
+// inspects the heap root, Delete scans for seq wherever it sits and uses
+// heap.Remove to take it out, which is what's needed to drop an
+// individually SACK-acked segment out of sendBuf: such a segment is
+// essentially never the smallest one still outstanding.
+func (t *segmentTree) Delete(seq uint32) (*segment, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, seg := range t.items {
+		if s, err := seg.Seq(); err == nil && s == seq {
+			removed := heap.Remove(&t.items, i).(*segment)
+			t.notFull.Broadcast()
+			return removed, true
+		}
+	}
+	return nil, false
+}
+
+// Ascend calls fn for every held segment in ascending sequence order,
+// stopping early if fn returns false. fn must not call back into this
+// segmentTree, since a snapshot of the current contents is taken up
+// front rather than iterated live.
+func (t *segmentTree) Ascend(fn func(*segment) bool) {
+	t.mu.Lock()
+	ordered := make(segmentHeap, len(t.items))
+	copy(ordered, t.items)
+	t.mu.Unlock()
+	sort.Sort(ordered)
+	for _, seg := range ordered {
+		if !fn(seg) {
+			return
+		}
+	}
+}
+
+// waitCtx waits on cond, also waking up if ctx is done. sync.Cond has no
+// native context support, so a helper goroutine bridges ctx.Done() into a
+// Broadcast; it exits as soon as the wait it was created for returns.
+func (t *segmentTree) waitCtx(ctx context.Context, cond *sync.Cond) {
+	if ctx.Done() == nil {
+		cond.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cond.Broadcast()
+		case <-done:
+		}
+	}()
+	cond.Wait()
+	close(done)
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import "testing"
+
+func dataSegment(seq uint32) *segment {
+	return &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{protocol: dataClientToServer},
+			sessionID:  1,
+			seq:        seq,
+		},
+	}
+}
+
+// TestSegmentTreeDeleteNonRoot would have caught ackSegment's former use
+// of DeleteMinIf to remove an individually SACK-acked segment: DeleteMinIf
+// only ever inspects the heap root, so a segment anywhere else in the
+// tree was silently never removed. Delete must find and remove it
+// regardless of where it sits.
+func TestSegmentTreeDeleteNonRoot(t *testing.T) {
+	tr := newSegmentTree(16)
+	for _, seq := range []uint32{5, 1, 3, 9, 7} {
+		tr.InsertBlocking(dataSegment(seq))
+	}
+
+	seg, ok := tr.Delete(7)
+	if !ok {
+		t.Fatalf("Delete(7) = _, false, want true")
+	}
+	if gotSeq, err := seg.Seq(); err != nil || gotSeq != 7 {
+		t.Errorf("Delete(7) returned segment with seq %d, err %v, want 7, nil", gotSeq, err)
+	}
+	if _, ok := tr.Get(7); ok {
+		t.Errorf("Get(7) found a segment after Delete(7)")
+	}
+	if got := tr.Len(); got != 4 {
+		t.Errorf("Len() = %d, want 4", got)
+	}
+
+	// The remaining root (the smallest sequence number) must still come
+	// out correctly after a non-root deletion reshuffles the heap.
+	min, ok := tr.DeleteMin()
+	if !ok || func() uint32 { s, _ := min.Seq(); return s }() != 1 {
+		t.Errorf("DeleteMin() after Delete(7) did not return seq 1")
+	}
+}
+
+// TestSegmentTreeDeleteMissing asserts Delete reports ok=false for a
+// sequence number that isn't present, without panicking or mutating the
+// tree.
+func TestSegmentTreeDeleteMissing(t *testing.T) {
+	tr := newSegmentTree(16)
+	tr.InsertBlocking(dataSegment(1))
+
+	if _, ok := tr.Delete(42); ok {
+		t.Errorf("Delete(42) = _, true, want false on an absent sequence number")
+	}
+	if got := tr.Len(); got != 1 {
+		t.Errorf("Len() = %d, want 1 after a no-op Delete", got)
+	}
+}
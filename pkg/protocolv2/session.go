@@ -28,6 +28,7 @@ import (
 	"github.com/enfein/mieru/pkg/mathext"
 	"github.com/enfein/mieru/pkg/metrics"
 	"github.com/enfein/mieru/pkg/netutil"
+	"github.com/enfein/mieru/pkg/pool"
 	"github.com/enfein/mieru/pkg/stderror"
 )
 
@@ -37,6 +38,15 @@ const (
 	minWindowSize       = 32
 	maxWindowSize       = 4096
 	segmentPollInterval = 10 * time.Millisecond
+
+	// maxAckDelay bounds how long data-carrying acks may be delayed before
+	// a standalone ack segment is sent instead.
+	maxAckDelay = 2 * segmentPollInterval
+
+	// maxSegmentRetries is the number of retransmissions, RTO-driven and
+	// fast retransmits alike, a single segment may go through before its
+	// next RTO expiry kills the session as unrecoverable.
+	maxSegmentRetries = 16
 )
 
 type sessionState int
@@ -50,6 +60,25 @@ const (
 	sessionClosed
 )
 
+func (st sessionState) String() string {
+	switch st {
+	case sessionInit:
+		return "sessionInit"
+	case sessionAttached:
+		return "sessionAttached"
+	case sessionOpening:
+		return "sessionOpening"
+	case sessionEstablished:
+		return "sessionEstablished"
+	case sessionClosing:
+		return "sessionClosing"
+	case sessionClosed:
+		return "sessionClosed"
+	default:
+		return fmt.Sprintf("sessionState(%d)", int(st))
+	}
+}
+
 type Session struct {
 	conn Underlay // underlay connection
 
@@ -67,17 +96,113 @@ type Session struct {
 	recvQueue *segmentTree  // segments waiting to be read by application
 	recvChan  chan *segment // channel to receive segment from underlay
 
-	nextSeq   uint32 // next sequence number to send a segment
-	nextRecv  uint32 // next sequence number to receive
-	unackSeq  uint32 // unacknowledged sequence number
-	unreadBuf []byte // payload removed from the recvQueue that haven't been read by application
+	nextSeq  uint32 // next sequence number to send a segment
+	nextRecv uint32 // next sequence number to receive
+	unackSeq uint32 // unacknowledged sequence number
+
+	// unreadBuf holds payload removed from recvQueue that the application
+	// hasn't read yet - either a fully reassembled message the caller's
+	// buffer was too short for, or a message still being reassembled
+	// fragment by fragment. unreadBufComplete tells Read and ReadSegment
+	// which case they're looking at: only when it's true is unreadBuf
+	// ready to hand to the caller. Without it, a read deadline expiring
+	// mid-reassembly would leave a partial message in unreadBuf that the
+	// next call's fast path would wrongly treat as complete, handing the
+	// caller a truncated payload.
+	unreadBuf         []byte
+	unreadBufComplete bool
+
+	// udpStateLock guards every field below it up to lastAckTime: all of
+	// them are read and written from both runOutputLoop (outputUDP) and
+	// runInputLoop (inputData, inputAck), which run concurrently on two
+	// different goroutines for the lifetime of the session. lastAckTime
+	// has a third writer besides those two: writeTimeout calls
+	// sendStandaloneAck directly from whatever goroutine called Write.
+	//
+	// nextRecv, although declared above this lock, is also read under it
+	// by recvProgress: inputData is the only goroutine that ever writes
+	// nextRecv, but outputUDP and sendStandaloneAck read it from
+	// runOutputLoop, so those reads need the same lock inputData's writes
+	// take.
+	udpStateLock sync.Mutex
+
+	// sendTime records when a segment held in sendBuf was last put on the
+	// wire, keyed by sequence number. It drives RTO-based retransmission.
+	sendTime map[uint32]time.Time
+
+	// origSendTime records the time a segment was first put on the wire.
+	// RTT samples are only taken from segments acked without ever being
+	// retransmitted (Karn's algorithm), so this is kept separate from
+	// sendTime, which is updated on every retransmission.
+	origSendTime map[uint32]time.Time
+
+	// retryCount is the number of times a segment still in sendBuf has
+	// been retransmitted.
+	retryCount map[uint32]int
+
+	// dupSackCount tracks, per sequence number missing in a reported SACK
+	// hole, how many times the hole has been observed, to drive fast
+	// retransmit after dupSackThreshold duplicate SACKs.
+	dupSackCount map[uint32]int
+
+	// oooRecvSeq holds sequence numbers that have reached recvBuf but are
+	// not contiguous with nextRecv yet. It is used to build SACK ranges
+	// to report back to the peer.
+	oooRecvSeq map[uint32]struct{}
+
+	// lastAckTime is the time the last ack (standalone or piggybacked)
+	// was sent to the peer.
+	lastAckTime time.Time
+
+	// sackEnabled reflects whether the channel-level version handshake
+	// found that both peers support SACK. It defaults to true so a
+	// Session created without going through setChannelParams (e.g. in
+	// tests) keeps the prior SACK-always-on behavior.
+	sackEnabled bool
 
 	rttStat       *congestion.RTTStats
 	sendAlgorithm *congestion.CubicSendAlgorithm
 
+	// metricNames holds the expvar names registerMetrics published, so
+	// cleanup can unregister them.
+	metricNames []string
+
+	// closeOnce guards cleanup, which must run exactly once regardless of
+	// whether the session ends via Close() or via the peer's
+	// closeSessionRequest/Response arriving in inputClose.
+	closeOnce sync.Once
+
 	wg    sync.WaitGroup
 	rLock sync.Mutex
 	wLock sync.Mutex
+
+	// rDeadline and wDeadline back Read and Write's blocking calls, so a
+	// Set*Deadline call made while one is already blocked interrupts it
+	// immediately instead of only affecting the next call.
+	rDeadline *deadlineSignal
+	wDeadline *deadlineSignal
+}
+
+// timeoutError is returned by Read and Write when the configured deadline
+// expires before the operation could complete. It implements net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mieru: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// readContext returns a context backed by s.rDeadline, so a
+// SetReadDeadline/SetDeadline call made while Read is already blocked on
+// the returned context interrupts it immediately.
+func (s *Session) readContext() (context.Context, context.CancelFunc) {
+	return deadlineContext{s.rDeadline}, func() {}
+}
+
+// writeContext returns a context backed by s.wDeadline, so a
+// SetWriteDeadline/SetDeadline call made while Write is already blocked
+// on the returned context interrupts it immediately.
+func (s *Session) writeContext() (context.Context, context.CancelFunc) {
+	return deadlineContext{s.wDeadline}, func() {}
 }
 
 // Session must implement net.Conn interface.
@@ -88,7 +213,7 @@ func NewSession(id uint32, isClient bool, mtu int) *Session {
 	rttStat := congestion.NewRTTStats()
 	rttStat.SetMaxAckDelay(2 * segmentPollInterval)
 	rttStat.SetRTOMultiplier(1.5)
-	return &Session{
+	s := &Session{
 		conn:          nil,
 		id:            id,
 		isClient:      isClient,
@@ -105,8 +230,48 @@ func NewSession(id uint32, isClient bool, mtu int) *Session {
 		nextSeq:       0,
 		nextRecv:      0,
 		unackSeq:      0,
+		sendTime:      make(map[uint32]time.Time),
+		origSendTime:  make(map[uint32]time.Time),
+		retryCount:    make(map[uint32]int),
+		dupSackCount:  make(map[uint32]int),
+		oooRecvSeq:    make(map[uint32]struct{}),
+		sackEnabled:   true,
 		rttStat:       rttStat,
 		sendAlgorithm: congestion.NewCubicSendAlgorithm(minWindowSize, maxWindowSize),
+		rDeadline:     newDeadlineSignal(),
+		wDeadline:     newDeadlineSignal(),
+	}
+	s.registerMetrics()
+	return s
+}
+
+// registerMetrics publishes this session's live gauges - buffer depths,
+// congestion window, and RTT/RTO - under pkg/metrics's Namespace, keyed
+// by session ID. NewSession calls it once, at construction.
+// The gauge names are recorded on s.metricNames so Close can unregister
+// them; otherwise Namespace would keep one stale entry set per session
+// for the life of the process.
+func (s *Session) registerMetrics() {
+	prefix := fmt.Sprintf("session.%d.", s.id)
+	s.metricNames = []string{
+		prefix + "sendBufDepth",
+		prefix + "recvBufDepth",
+		prefix + "congestionWindow",
+		prefix + "smoothedRTTMillis",
+		prefix + "rtoMillis",
+	}
+	metrics.RegisterGauge(s.metricNames[0], func() any { return s.sendBuf.Len() })
+	metrics.RegisterGauge(s.metricNames[1], func() any { return s.recvBuf.Len() })
+	metrics.RegisterGauge(s.metricNames[2], func() any { return s.sendAlgorithm.CongestionWindowSize() })
+	metrics.RegisterGauge(s.metricNames[3], func() any { return s.rttStat.SmoothedRTT().Milliseconds() })
+	metrics.RegisterGauge(s.metricNames[4], func() any { return s.rttStat.RTO().Milliseconds() })
+}
+
+// unregisterMetrics removes every gauge registerMetrics published for
+// this session.
+func (s *Session) unregisterMetrics() {
+	for _, name := range s.metricNames {
+		metrics.UnregisterGauge(name)
 	}
 }
 
@@ -134,20 +299,32 @@ func (s *Session) Read(b []byte) (n int, err error) {
 
 	// There are some remaining data that application
 	// failed to read last time due to short buffer.
-	if len(s.unreadBuf) > 0 {
+	if s.unreadBufComplete {
 		if len(b) < len(s.unreadBuf) {
 			return 0, io.ErrShortBuffer
 		}
 		n = copy(b, s.unreadBuf)
+		pool.Put(s.unreadBuf)
 		s.unreadBuf = nil
+		s.unreadBufComplete = false
 		metrics.InBytes.Add(int64(n))
 		return n, nil
 	}
 
-	// Read all the fragments of the original message.
+	// Read all the fragments of the original message, resuming from
+	// whatever unreadBuf already holds if a previous call's deadline
+	// expired partway through reassembly.
+	ctx, cancel := s.readContext()
+	defer cancel()
 	for {
-		seg, ok := s.recvQueue.DeleteMinBlocking()
+		seg, ok := s.recvQueue.DeleteMinBlockingCtx(ctx)
 		if !ok {
+			if ctx.Err() != nil {
+				// unreadBuf, if non-empty, is an incomplete message:
+				// unreadBufComplete stays false so the next call resumes
+				// reassembly here instead of delivering it as-is.
+				return 0, timeoutError{}
+			}
 			// recvQueue is dead.
 			return 0, io.EOF
 		}
@@ -159,7 +336,8 @@ func (s *Session) Read(b []byte) (n int, err error) {
 		}
 
 		if len(s.unreadBuf) == 0 {
-			s.unreadBuf = seg.payload
+			s.unreadBuf = pool.Get(len(seg.payload))
+			copy(s.unreadBuf, seg.payload)
 		} else {
 			s.unreadBuf = append(s.unreadBuf, seg.payload...)
 		}
@@ -172,16 +350,80 @@ func (s *Session) Read(b []byte) (n int, err error) {
 			break
 		}
 	}
+	s.unreadBufComplete = true
 
 	if len(b) < len(s.unreadBuf) {
 		return 0, io.ErrShortBuffer
 	}
 	n = copy(b, s.unreadBuf)
+	pool.Put(s.unreadBuf)
 	s.unreadBuf = nil
+	s.unreadBufComplete = false
 	metrics.InBytes.Add(int64(n))
 	return n, nil
 }
 
+// ReadSegment reads one already-reassembled message from the session
+// without copying it into a caller-supplied buffer: ownership of the
+// returned slice, which comes from pkg/pool, transfers to the caller. The
+// caller should call pool.Put on it once done, or simply let it be
+// garbage collected.
+func (s *Session) ReadSegment() ([]byte, error) {
+	if s.state < sessionAttached {
+		return nil, fmt.Errorf("%v is not ready for Read()", s)
+	}
+	if s.state >= sessionClosed {
+		return nil, io.ErrClosedPipe
+	}
+	s.rLock.Lock()
+	defer s.rLock.Unlock()
+
+	if s.unreadBufComplete {
+		b := s.unreadBuf
+		s.unreadBuf = nil
+		s.unreadBufComplete = false
+		metrics.InBytes.Add(int64(len(b)))
+		return b, nil
+	}
+
+	// Resume from whatever unreadBuf already holds if a previous call's
+	// deadline expired partway through reassembly, the same way Read does
+	// - ReadSegment and Read share unreadBuf/unreadBufComplete, since a
+	// caller may freely mix the two across calls.
+	ctx, cancel := s.readContext()
+	defer cancel()
+	for {
+		seg, ok := s.recvQueue.DeleteMinBlockingCtx(ctx)
+		if !ok {
+			if ctx.Err() != nil {
+				return nil, timeoutError{}
+			}
+			return nil, io.EOF
+		}
+		if s.isClient && seg.metadata.Protocol() == openSessionResponse && (s.state == sessionAttached || s.state == sessionOpening) {
+			s.forwardStateTo(sessionEstablished)
+			close(s.established)
+		}
+		if len(s.unreadBuf) == 0 {
+			s.unreadBuf = pool.Get(len(seg.payload))
+			copy(s.unreadBuf, seg.payload)
+		} else {
+			s.unreadBuf = append(s.unreadBuf, seg.payload...)
+		}
+		fragment, err := seg.Fragment()
+		if err != nil {
+			return nil, fmt.Errorf("Fragment() failed: %w", err)
+		}
+		if fragment == 0 {
+			break
+		}
+	}
+	b := s.unreadBuf
+	s.unreadBuf = nil
+	metrics.InBytes.Add(int64(len(b)))
+	return b, nil
+}
+
 // Write stores the data to send queue.
 func (s *Session) Write(b []byte) (n int, err error) {
 	if len(b) > MaxPDU {
@@ -196,6 +438,9 @@ func (s *Session) Write(b []byte) (n int, err error) {
 	s.wLock.Lock()
 	defer s.wLock.Unlock()
 
+	ctx, cancel := s.writeContext()
+	defer cancel()
+
 	if s.state == sessionAttached {
 		if s.isClient {
 			// Send open session request.
@@ -213,12 +458,20 @@ func (s *Session) Write(b []byte) (n int, err error) {
 			s.nextSeq++
 			if len(b) <= maxSessionOpenPDU {
 				seg.metadata.(*sessionStruct).payloadLen = uint16(len(b))
-				seg.payload = b
+				// Copy into a pooled buffer rather than aliasing the
+				// caller's b: seg is retained until acked, and pool.Put
+				// on the wire-write path must never hand the caller's
+				// own buffer back into the pool.
+				payload := pool.Get(len(b))
+				copy(payload, b)
+				seg.payload = payload
 			}
 			if log.IsLevelEnabled(log.TraceLevel) {
 				log.Tracef("%v writing %d bytes with open session request", s, len(seg.payload))
 			}
-			s.sendQueue.InsertBlocking(seg)
+			if !s.sendQueue.InsertBlockingCtx(ctx, seg) {
+				return 0, s.writeTimeout()
+			}
 			s.forwardStateTo(sessionOpening)
 			if len(seg.payload) > 0 {
 				return len(seg.payload), nil
@@ -239,12 +492,18 @@ func (s *Session) Write(b []byte) (n int, err error) {
 			s.nextSeq++
 			if len(b) <= maxSessionOpenPDU {
 				seg.metadata.(*sessionStruct).payloadLen = uint16(len(b))
-				seg.payload = b
+				// Copy into a pooled buffer for the same reason as the
+				// open session request branch above.
+				payload := pool.Get(len(b))
+				copy(payload, b)
+				seg.payload = payload
 			}
 			if log.IsLevelEnabled(log.TraceLevel) {
 				log.Tracef("%v writing %d bytes with open session response", s, len(seg.payload))
 			}
-			s.sendQueue.InsertBlocking(seg)
+			if !s.sendQueue.InsertBlockingCtx(ctx, seg) {
+				return 0, s.writeTimeout()
+			}
 			s.forwardStateTo(sessionEstablished)
 			if len(seg.payload) > 0 {
 				return len(seg.payload), nil
@@ -261,6 +520,12 @@ func (s *Session) Write(b []byte) (n int, err error) {
 		log.Tracef("%v writing %d bytes with %d fragments", s, len(b), nFragment)
 	}
 
+	// Piggyback the latest cumulative ack on the data segment(s) about to
+	// go out, instead of leaving unAckSeq stuck at 0 and forcing the peer
+	// to wait for the next standalone ack.
+	nextRecv, _ := s.recvProgress()
+	s.unackSeq = nextRecv
+
 	ptr := b
 	for i := nFragment - 1; i >= 0; i-- {
 		var protocol uint8
@@ -270,7 +535,12 @@ func (s *Session) Write(b []byte) (n int, err error) {
 			protocol = dataServerToClient
 		}
 		partLen := mathext.Min(fragmentSize, len(ptr))
-		part := ptr[:partLen]
+		// Copy into a pooled buffer rather than aliasing the caller's b:
+		// once a segment is retained in sendBuf for possible
+		// retransmission, the caller remains free to reuse or overwrite
+		// b after Write returns.
+		part := pool.Get(partLen)
+		copy(part, ptr[:partLen])
 		seg := &segment{
 			metadata: &dataAckStruct{
 				baseStruct: baseStruct{
@@ -286,7 +556,9 @@ func (s *Session) Write(b []byte) (n int, err error) {
 			payload: part,
 		}
 		s.nextSeq++
-		s.sendQueue.InsertBlocking(seg)
+		if !s.sendQueue.InsertBlockingCtx(ctx, seg) {
+			return len(b) - len(ptr), s.writeTimeout()
+		}
 		ptr = ptr[partLen:]
 	}
 	n = len(b)
@@ -294,12 +566,74 @@ func (s *Session) Write(b []byte) (n int, err error) {
 	return n, nil
 }
 
+// WriteSegment writes b as a single segment's payload, transferring
+// ownership of b to the session instead of copying it the way Write does.
+// b should come from pool.Get, and the caller must not touch it again
+// after this call returns nil. If b doesn't fit in a single fragment,
+// WriteSegment falls back to Write, which does copy.
+func (s *Session) WriteSegment(b []byte) error {
+	if len(b) > MaxPDU {
+		return io.ErrShortWrite
+	}
+	if s.state < sessionAttached {
+		return fmt.Errorf("%v is not ready for Write()", s)
+	}
+	if s.state >= sessionClosed {
+		return io.ErrClosedPipe
+	}
+
+	// The handshake segments and the multi-fragment case are rare and
+	// not worth a zero-copy path; Write already handles them correctly.
+	fragmentSize := MaxFragmentSize(s.mtu, s.conn.IPVersion(), s.conn.TransportProtocol())
+	if s.state == sessionAttached || len(b) > fragmentSize {
+		_, err := s.Write(b)
+		return err
+	}
+
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+
+	ctx, cancel := s.writeContext()
+	defer cancel()
+
+	var protocol uint8
+	if s.isClient {
+		protocol = dataClientToServer
+	} else {
+		protocol = dataServerToClient
+	}
+	// Piggyback the latest cumulative ack, same as Write does.
+	nextRecv, _ := s.recvProgress()
+	s.unackSeq = nextRecv
+	seg := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: protocol,
+			},
+			sessionID:  s.id,
+			seq:        s.nextSeq,
+			unAckSeq:   s.unackSeq,
+			windowSize: uint16(s.recvBuf.Remaining()),
+			fragment:   0,
+			payloadLen: uint16(len(b)),
+		},
+		payload: b,
+	}
+	s.nextSeq++
+	if !s.sendQueue.InsertBlockingCtx(ctx, seg) {
+		return s.writeTimeout()
+	}
+	metrics.OutBytes.Add(int64(len(b)))
+	return nil
+}
+
 // Close actively terminates the session. If the session is terminated by the
 // other party, underlay is responsible to terminate the session at our end.
 func (s *Session) Close() error {
 	select {
 	case <-s.done:
 		s.forwardStateTo(sessionClosed)
+		s.cleanup()
 		log.Debugf("%v is already closed", s)
 		return nil
 	default:
@@ -327,9 +661,28 @@ func (s *Session) Close() error {
 	s.sendQueue.InsertBlocking(seg)
 	<-s.done
 	s.forwardStateTo(sessionClosed)
+	s.cleanup()
 	return nil
 }
 
+// cleanup releases resources tied to this session's lifetime that aren't
+// already torn down by runInputLoop/runOutputLoop returning: the metrics
+// gauges registerMetrics published, and the underlying send/recv
+// segmentTrees, whose blocked callers (if any) need to be woken up. It
+// runs exactly once no matter which of Close or inputClose triggers it.
+func (s *Session) cleanup() {
+	s.closeOnce.Do(func() {
+		s.unregisterMetrics()
+		s.sendQueue.Close()
+		s.sendBuf.Close()
+		s.recvBuf.Close()
+		s.recvQueue.Close()
+		if s.conn != nil {
+			releaseUnderlayWriter(s.conn)
+		}
+	})
+}
+
 func (s *Session) LocalAddr() net.Addr {
 	return s.conn.LocalAddr()
 }
@@ -339,15 +692,64 @@ func (s *Session) RemoteAddr() net.Addr {
 }
 
 func (s *Session) SetDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.rDeadline.set(t)
+	s.wDeadline.set(t)
+	return nil
 }
 
 func (s *Session) SetReadDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.rDeadline.set(t)
+	return nil
 }
 
 func (s *Session) SetWriteDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.wDeadline.set(t)
+	return nil
+}
+
+// writeTimeout returns the error Write should surface when its deadline
+// expires with data still enqueued. It also flushes a standalone ack on a
+// best-effort basis, so a peer polling with short write deadlines still
+// observes progress even though this write didn't fully go through.
+func (s *Session) writeTimeout() error {
+	if s.conn != nil && s.conn.TransportProtocol() == netutil.UDPTransport {
+		if err := s.sendStandaloneAck(); err != nil && log.IsLevelEnabled(log.DebugLevel) {
+			log.Debugf("%v failed to flush ack on write timeout: %v", s, err)
+		}
+	}
+	return timeoutError{}
+}
+
+// setChannelParams applies the outcome of the channel's version handshake
+// to this Session: it adopts the negotiated MTU and enables SACK only if
+// both peers advertised support for it.
+func (s *Session) setChannelParams(h versionHandshake) {
+	if h.mtu > 0 {
+		s.mtu = int(h.mtu)
+	}
+	s.sackEnabled = h.capabilities&capSACK != 0
+}
+
+// negotiatedChannel is implemented by underlays that already performed a
+// version handshake with the peer at setup time, such as UDPUnderlay.
+// TCPUnderlay doesn't implement it yet, since its framing predates the
+// version handshake; a Session attached to one keeps the pre-handshake
+// defaults (SACK enabled, caller-supplied MTU).
+type negotiatedChannel interface {
+	Negotiated() versionHandshake
+}
+
+// AttachUnderlay binds the session to conn, the entry point through which
+// s.conn is populated. If conn already negotiated channel parameters with
+// the peer, the session adopts them via setChannelParams before moving to
+// sessionAttached.
+func (s *Session) AttachUnderlay(conn Underlay) {
+	s.conn = conn
+	if nc, ok := conn.(negotiatedChannel); ok {
+		s.setChannelParams(nc.Negotiated())
+	}
+	acquireUnderlayWriter(conn)
+	s.forwardStateTo(sessionAttached)
 }
 
 func (s *Session) forwardStateTo(new sessionState) {
@@ -355,6 +757,8 @@ func (s *Session) forwardStateTo(new sessionState) {
 		panic(fmt.Sprintf("Can't move state back from %v to %v", s.state, new))
 	}
 	s.state = new
+	metrics.SessionStateTransitions.Add(new.String(), 1)
+	log.Infof("%v moved to state %v", s, new)
 }
 
 func (s *Session) runInputLoop(ctx context.Context) error {
@@ -382,20 +786,19 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 		default:
 			switch s.conn.TransportProtocol() {
 			case netutil.TCPTransport:
-				for {
-					seg, ok := s.sendQueue.DeleteMin()
-					if !ok {
-						time.Sleep(segmentPollInterval)
-						break
-					}
-					if err := s.output(seg); err != nil {
-						return fmt.Errorf("output() failed: %v", err)
-					}
+				seg, ok := s.sendQueue.DeleteMinBlocking()
+				if !ok {
+					// sendQueue is dead.
+					return nil
+				}
+				if err := s.output(seg); err != nil {
+					return fmt.Errorf("output() failed: %v", err)
 				}
 			case netutil.UDPTransport:
-				// Delete segments that are acked in sendBuf.
-				// Refill sendBuf with segments from sendQueue.
-				// Flush sendBuf.
+				if err := s.outputUDP(); err != nil {
+					return fmt.Errorf("outputUDP() failed: %v", err)
+				}
+				time.Sleep(segmentPollInterval)
 			default:
 				return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 			}
@@ -403,6 +806,162 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 	}
 }
 
+// outputUDP drives one tick of the UDP reliability loop: it refills
+// sendBuf from sendQueue up to the current congestion window, retransmits
+// any segment in sendBuf whose age exceeds the current RTO, and sends a
+// standalone ack when data hasn't carried one out within maxAckDelay.
+func (s *Session) outputUDP() error {
+	// Refill sendBuf from sendQueue, bounded by the congestion window.
+	// sendBuf already holds exactly the segments currently in flight, so
+	// inFlightSegments() alone - not sendBuf.Len() plus it - is compared
+	// against the window.
+	for s.inFlightSegments() < s.sendAlgorithm.CongestionWindowSize() {
+		seg, ok := s.sendQueue.DeleteMin()
+		if !ok {
+			break
+		}
+		seq, err := seg.Seq()
+		if err != nil {
+			return fmt.Errorf("Seq() failed: %w", err)
+		}
+		s.sendBuf.InsertBlocking(seg)
+		now := time.Now()
+		s.udpStateLock.Lock()
+		s.sendTime[seq] = now
+		s.origSendTime[seq] = now
+		s.lastAckTime = now
+		s.udpStateLock.Unlock()
+		if err := s.output(seg); err != nil {
+			return fmt.Errorf("output() failed: %v", err)
+		}
+	}
+
+	// Retransmit segments that have been outstanding longer than the RTO,
+	// walking sendBuf in sequence order.
+	rto := s.rttStat.RTO()
+	now := time.Now()
+	var sessionDead error
+	s.sendBuf.Ascend(func(seg *segment) bool {
+		seq, err := seg.Seq()
+		if err != nil {
+			panic(fmt.Sprintf("%v get segment sequence number failed: %v", s, err))
+		}
+		retransmit, dead := s.shouldRetransmit(seq, now, rto)
+		if dead != nil {
+			sessionDead = dead
+			return false
+		}
+		if !retransmit {
+			return true
+		}
+		if err := s.outputWithPriority(seg, priorityRetransmission); err != nil {
+			sessionDead = fmt.Errorf("outputWithPriority() failed: %v", err)
+			return false
+		}
+		metrics.SegmentsRetransmitted.Add(1)
+		return true
+	})
+	if sessionDead != nil {
+		return sessionDead
+	}
+
+	// Send a standalone ack if data hasn't piggybacked one recently and
+	// anything has been received at all. The ack is repeated every
+	// maxAckDelay even when nextRecv hasn't advanced since the last one.
+	nextRecv, oooPending := s.recvProgress()
+	if time.Since(s.getLastAckTime()) >= maxAckDelay && (nextRecv > 0 || oooPending) {
+		if err := s.sendStandaloneAck(); err != nil {
+			return fmt.Errorf("sendStandaloneAck() failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// shouldRetransmit decides, under udpStateLock, whether the segment at seq
+// has been outstanding longer than rto and is due for retransmission. If
+// so, it bumps retryCount, resets sendTime/origSendTime for seq, and
+// reports the loss to sendAlgorithm before returning true. dead is
+// non-nil if the segment has already exceeded maxSegmentRetries and the
+// session must be killed.
+func (s *Session) shouldRetransmit(seq uint32, now time.Time, rto time.Duration) (retransmit bool, dead error) {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	sent, ok := s.sendTime[seq]
+	if !ok || now.Sub(sent) < rto {
+		return false, nil
+	}
+	if s.retryCount[seq] >= maxSegmentRetries {
+		return false, fmt.Errorf("segment %d exceeded %d retransmissions, killing %v", seq, maxSegmentRetries, s)
+	}
+	s.retryCount[seq]++
+	// Karn's algorithm: a retransmitted segment's original send time can
+	// no longer be used to sample RTT.
+	delete(s.origSendTime, seq)
+	s.sendTime[seq] = now
+	s.sendAlgorithm.OnLoss(now)
+	return true, nil
+}
+
+// inFlightSegments returns the number of segments currently sent but not
+// yet acknowledged, i.e. held in sendBuf, compared against the congestion
+// window (itself sized in segments, matching segmentTreeCapacity) to
+// decide how much more may be sent.
+func (s *Session) inFlightSegments() int {
+	return s.sendBuf.Len()
+}
+
+// getLastAckTime returns lastAckTime under udpStateLock. lastAckTime is
+// written from both runOutputLoop (outputUDP, sendStandaloneAck) and
+// whatever goroutine calls Write, since writeTimeout calls
+// sendStandaloneAck directly; reading it without the lock would race with
+// those writers.
+func (s *Session) getLastAckTime() time.Time {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	return s.lastAckTime
+}
+
+// recvProgress returns nextRecv and whether oooRecvSeq currently holds any
+// out-of-order sequence numbers, both read under udpStateLock. inputData
+// is the only writer of either, but it writes them under this same lock,
+// so any reader outside runInputLoop's own goroutine must go through this
+// accessor instead of reading s.nextRecv or s.oooRecvSeq directly.
+func (s *Session) recvProgress() (nextRecv uint32, oooPending bool) {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	return s.nextRecv, len(s.oooRecvSeq) > 0
+}
+
+// sendStandaloneAck builds and sends an ack-only segment carrying the
+// cumulative unAckSeq plus any SACK ranges built from out-of-order
+// arrivals in recvBuf. It may run on either runOutputLoop's goroutine or,
+// via writeTimeout, whatever goroutine called Write, so lastAckTime is
+// updated under udpStateLock.
+func (s *Session) sendStandaloneAck() error {
+	var protocol uint8
+	if s.isClient {
+		protocol = ackClientToServer
+	} else {
+		protocol = ackServerToClient
+	}
+	nextRecv, _ := s.recvProgress()
+	seg := &segment{
+		metadata: &ackStruct{
+			baseStruct: baseStruct{
+				protocol: protocol,
+			},
+			sessionID:  s.id,
+			unAckSeq:   nextRecv,
+			windowSize: uint16(s.recvBuf.Remaining()),
+			sackRanges: s.sackRangesIfEnabled(),
+		},
+	}
+	s.udpStateLock.Lock()
+	s.lastAckTime = time.Now()
+	s.udpStateLock.Unlock()
+	return s.output(seg)
+}
+
 // input reads incoming packets from network and assemble
 // them in the receive buffer and receive queue.
 func (s *Session) input(seg *segment) error {
@@ -412,13 +971,16 @@ func (s *Session) input(seg *segment) error {
 	protocol := seg.Protocol()
 	if s.isClient {
 		if protocol != openSessionResponse && protocol != dataServerToClient && protocol != ackServerToClient && protocol != closeSessionRequest && protocol != closeSessionResponse {
+			metrics.SegmentsDropped.Add(metrics.DropReasonInvalidProtocol, 1)
 			return stderror.ErrInvalidArgument
 		}
 	} else {
 		if protocol != openSessionRequest && protocol != dataClientToServer && protocol != ackClientToServer && protocol != closeSessionRequest && protocol != closeSessionResponse {
+			metrics.SegmentsDropped.Add(metrics.DropReasonInvalidProtocol, 1)
 			return stderror.ErrInvalidArgument
 		}
 	}
+	metrics.SegmentsReceived.Add(1)
 	if protocol == openSessionRequest || protocol == openSessionResponse || protocol == dataServerToClient || protocol == dataClientToServer {
 		return s.inputData(seg)
 	} else if protocol == ackServerToClient || protocol == ackClientToServer {
@@ -438,6 +1000,15 @@ func (s *Session) inputData(seg *segment) error {
 	case netutil.UDPTransport:
 		// Deliver the segment to recvBuf.
 		s.recvBuf.InsertBlocking(seg)
+		seq, err := seg.Seq()
+		if err != nil {
+			panic(fmt.Sprintf("%v get segment sequence number failed: %v", s, err))
+		}
+		if seq > s.nextRecv {
+			s.udpStateLock.Lock()
+			s.oooRecvSeq[seq] = struct{}{}
+			s.udpStateLock.Unlock()
+		}
 		// Move recvBuf to recvQueue.
 		for {
 			seg, deleted := s.recvBuf.DeleteMinIf(func(iter *segment) bool {
@@ -459,7 +1030,10 @@ func (s *Session) inputData(seg *segment) error {
 			}
 			if seq == s.nextRecv {
 				s.recvQueue.InsertBlocking(seg)
+				s.udpStateLock.Lock()
+				delete(s.oooRecvSeq, seq)
 				s.nextRecv++
+				s.udpStateLock.Unlock()
 			}
 		}
 	default:
@@ -473,30 +1047,148 @@ func (s *Session) inputAck(seg *segment) error {
 		// Do nothing when receive ACK from TCP protocol.
 		return nil
 	case netutil.UDPTransport:
-		// Delete all previous acknowledged segments.
-		das := seg.metadata.(*dataAckStruct)
-		unAckSeq := das.unAckSeq
-		for {
-			_, deleted := s.sendBuf.DeleteMinIf(func(iter *segment) bool {
-				seq, err := iter.Seq()
-				if err != nil {
-					panic(fmt.Sprintf("%v get segment sequence number failed: %v", s, err))
-				}
-				if seq < unAckSeq {
-					return true
+		var unAckSeq uint32
+		var sacks []sackRange
+		switch meta := seg.metadata.(type) {
+		case *dataAckStruct:
+			unAckSeq = meta.unAckSeq
+		case *ackStruct:
+			unAckSeq = meta.unAckSeq
+			sacks = meta.sackRanges
+		default:
+			return stderror.ErrInvalidArgument
+		}
+
+		now := time.Now()
+		// Delete all cumulatively acknowledged segments, sampling RTT
+		// from any that were never retransmitted (Karn's algorithm).
+		s.ackSegmentsBefore(unAckSeq, now)
+
+		// Delete segments individually covered by SACK ranges, and count
+		// duplicate SACKs ahead of a hole to drive fast retransmit. sacks
+		// arrive sorted ascending (buildSackRanges produces them that
+		// way), so expect tracks the next seq we haven't accounted for
+		// yet; everything between expect and a range's left edge is a
+		// hole, which may span more than the single segment immediately
+		// before the range.
+		expect := unAckSeq
+		for _, r := range sacks {
+			for seq := r.left; seq <= r.right; seq++ {
+				s.ackSegment(seq, now)
+			}
+			for holeSeq := expect; holeSeq < r.left; holeSeq++ {
+				if s.countDupSack(holeSeq) {
+					if seg, ok := s.sendBuf.Get(holeSeq); ok {
+						s.markRetransmitted(holeSeq, now)
+						if err := s.outputWithPriority(seg, priorityRetransmission); err != nil {
+							return fmt.Errorf("outputWithPriority() failed: %v", err)
+						}
+						metrics.SegmentsRetransmitted.Add(1)
+					}
 				}
-				return false
-			})
-			if !deleted {
-				break
 			}
+			expect = r.right + 1
 		}
+
 		return nil
 	default:
 		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 	}
 }
 
+// ackSegmentsBefore removes every segment in sendBuf with a sequence number
+// below unAckSeq, sampling an RTT update for each one that was never
+// retransmitted.
+func (s *Session) ackSegmentsBefore(unAckSeq uint32, now time.Time) {
+	for {
+		seg, deleted := s.sendBuf.DeleteMinIf(func(iter *segment) bool {
+			seq, err := iter.Seq()
+			if err != nil {
+				panic(fmt.Sprintf("%v get segment sequence number failed: %v", s, err))
+			}
+			return seq < unAckSeq
+		})
+		if seg == nil || !deleted {
+			return
+		}
+		seq, err := seg.Seq()
+		if err != nil {
+			panic(fmt.Sprintf("%v get segment sequence number failed: %v", s, err))
+		}
+		s.sampleRTT(seq, now)
+		s.forgetSegment(seq)
+		s.sendAlgorithm.OnAck(now)
+		pool.Put(seg.payload)
+	}
+}
+
+// ackSegment removes a single segment covered by a SACK range, sampling an
+// RTT update if it was never retransmitted. Unlike ackSegmentsBefore, the
+// segment being acked here is individually SACKed rather than
+// cumulatively acked, so it's essentially never the smallest sequence
+// number still in sendBuf; Delete scans for it wherever it sits instead
+// of only inspecting the heap root.
+func (s *Session) ackSegment(seq uint32, now time.Time) {
+	seg, ok := s.sendBuf.Delete(seq)
+	if !ok {
+		return
+	}
+	s.sampleRTT(seq, now)
+	s.forgetSegment(seq)
+	s.sendAlgorithm.OnAck(now)
+	pool.Put(seg.payload)
+}
+
+// sampleRTT feeds rttStat a new RTT sample for seq, unless the segment was
+// retransmitted at least once, per Karn's algorithm.
+func (s *Session) sampleRTT(seq uint32, now time.Time) {
+	s.udpStateLock.Lock()
+	sent, ok := s.origSendTime[seq]
+	s.udpStateLock.Unlock()
+	if ok {
+		s.rttStat.UpdateRTT(now.Sub(sent), 0, now)
+	}
+}
+
+// forgetSegment drops all per-segment bookkeeping for seq once it leaves
+// sendBuf by being acked, cumulatively or by SACK.
+func (s *Session) forgetSegment(seq uint32) {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	delete(s.sendTime, seq)
+	delete(s.origSendTime, seq)
+	delete(s.retryCount, seq)
+	delete(s.dupSackCount, seq)
+}
+
+// countDupSack records one more duplicate SACK report of the hole at
+// holeSeq, returning true once it has reached dupSackThreshold. Once fast
+// retransmit fires, the count is reset so a hole that keeps getting
+// reported doesn't retransmit on every single ack.
+func (s *Session) countDupSack(holeSeq uint32) bool {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	s.dupSackCount[holeSeq]++
+	if s.dupSackCount[holeSeq] >= dupSackThreshold {
+		delete(s.dupSackCount, holeSeq)
+		return true
+	}
+	return false
+}
+
+// markRetransmitted records that the segment at holeSeq is being fast
+// retransmitted right now, resetting its RTO clock, forgetting any prior
+// RTT eligibility per Karn's algorithm, and reporting the loss to
+// sendAlgorithm.
+func (s *Session) markRetransmitted(holeSeq uint32, now time.Time) {
+	s.udpStateLock.Lock()
+	defer s.udpStateLock.Unlock()
+	delete(s.origSendTime, holeSeq)
+	s.sendTime[holeSeq] = now
+	s.retryCount[holeSeq]++
+	s.sendAlgorithm.OnLoss(now)
+}
+
 func (s *Session) inputClose(seg *segment) error {
 	if seg.metadata.Protocol() == closeSessionRequest {
 		// Send close session response.
@@ -522,6 +1214,7 @@ func (s *Session) inputClose(seg *segment) error {
 		}
 		close(s.done)
 		s.forwardStateTo(sessionClosed)
+		s.cleanup()
 	} else if seg.metadata.Protocol() == closeSessionResponse {
 		// Immediately shutdown event loop.
 		if log.IsLevelEnabled(log.TraceLevel) {
@@ -529,21 +1222,30 @@ func (s *Session) inputClose(seg *segment) error {
 		}
 		close(s.done)
 		s.forwardStateTo(sessionClosed)
+		s.cleanup()
 	}
 	return nil
 }
 
+// output schedules seg to be written to the underlay, classifying its
+// priority from its protocol. Use outputWithPriority directly when the
+// caller knows better, e.g. a retransmission.
 func (s *Session) output(seg *segment) error {
+	return s.outputWithPriority(seg, classifyPriority(seg))
+}
+
+// outputWithPriority hands seg to the Session's underlay writer, which
+// fairly schedules it against every other Session sharing the same
+// underlay. The write itself happens asynchronously on the writer's
+// goroutine; errors are logged there rather than returned here, matching
+// the fire-and-forget nature of a bounded, backpressured queue.
+func (s *Session) outputWithPriority(seg *segment, prio segmentPriority) error {
 	if log.IsLevelEnabled(log.TraceLevel) {
 		log.Tracef("%v output %v", s, seg)
 	}
-	switch s.conn.TransportProtocol() {
-	case netutil.TCPTransport:
-		if err := s.conn.(*TCPUnderlay).writeOneSegment(seg); err != nil {
-			return fmt.Errorf("TCPUnderlay.writeOneSegment() failed: %v", err)
-		}
-	default:
-		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+	if s.conn == nil {
+		return fmt.Errorf("%v has no underlay to write to", s)
 	}
+	getUnderlayWriter(s.conn).enqueue(seg, prio)
 	return nil
 }
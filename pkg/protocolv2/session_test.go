@@ -0,0 +1,120 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/netutil"
+)
+
+func newTestUDPSession(t *testing.T) (*Session, *fakeUnderlay) {
+	t.Helper()
+	s := NewSession(1, true, 1400)
+	u := &fakeUnderlay{transport: netutil.UDPTransport}
+	s.AttachUnderlay(u)
+	t.Cleanup(s.cleanup)
+	return s, u
+}
+
+// TestInputAckFastRetransmitsWholeGap would have caught fast retransmit
+// only ever firing for the single segment immediately before a SACK
+// range (holeSeq := r.left - 1): when more than one segment is missing
+// ahead of a reported range, every earlier one used to silently wait out
+// a full RTO instead of being fast retransmitted alongside the last one.
+func TestInputAckFastRetransmitsWholeGap(t *testing.T) {
+	s, u := newTestUDPSession(t)
+
+	for _, seq := range []uint32{10, 11, 12} {
+		s.sendBuf.InsertBlocking(dataSegment(seq))
+	}
+
+	ack := &segment{
+		metadata: &ackStruct{
+			baseStruct: baseStruct{protocol: ackServerToClient},
+			sessionID:  s.id,
+			unAckSeq:   10,
+			sackRanges: []sackRange{{left: 13, right: 13}},
+		},
+	}
+
+	// dupSackThreshold duplicate reports of the same hole are required
+	// before fast retransmit fires.
+	for i := 0; i < dupSackThreshold; i++ {
+		if err := s.inputAck(ack); err != nil {
+			t.Fatalf("inputAck() failed: %v", err)
+		}
+	}
+
+	retransmitted := make(map[uint32]bool)
+	deadline := time.After(time.Second)
+	for len(retransmitted) < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("only %d of 3 gap segments were retransmitted: %v", len(retransmitted), retransmitted)
+		case <-time.After(time.Millisecond):
+		}
+		for _, seg := range u.snapshot() {
+			seq, err := seg.Seq()
+			if err != nil {
+				t.Fatalf("Seq() failed: %v", err)
+			}
+			retransmitted[seq] = true
+		}
+	}
+	for _, seq := range []uint32{10, 11, 12} {
+		if !retransmitted[seq] {
+			t.Errorf("seq %d in the SACK gap was never fast retransmitted", seq)
+		}
+	}
+}
+
+// TestSampleRTTSkipsRetransmittedSegment would have caught a Karn's
+// algorithm regression: a segment with no origSendTime entry (because it
+// was already retransmitted at least once, which forgetSegment/
+// markRetransmitted deletes the entry for) must never feed an RTT sample,
+// since the sample would be ambiguous about which transmission it
+// actually timed.
+func TestSampleRTTSkipsRetransmittedSegment(t *testing.T) {
+	s, _ := newTestUDPSession(t)
+
+	s.sampleRTT(42, time.Now())
+
+	if got := s.rttStat.SmoothedRTT(); got != 0 {
+		t.Errorf("SmoothedRTT() = %v after sampling a segment with no origSendTime, want 0", got)
+	}
+}
+
+// TestSampleRTTUpdatesForNeverRetransmittedSegment is the complement of
+// TestSampleRTTSkipsRetransmittedSegment: a segment that was never
+// retransmitted still has its origSendTime entry, and must produce an
+// RTT sample.
+func TestSampleRTTUpdatesForNeverRetransmittedSegment(t *testing.T) {
+	s, _ := newTestUDPSession(t)
+
+	sentAt := time.Now().Add(-30 * time.Millisecond)
+	s.udpStateLock.Lock()
+	s.origSendTime[42] = sentAt
+	s.udpStateLock.Unlock()
+
+	s.sampleRTT(42, time.Now())
+
+	got := s.rttStat.SmoothedRTT()
+	if got <= 0 || got > time.Second {
+		t.Errorf("SmoothedRTT() = %v after sampling a never-retransmitted segment, want a small positive duration", got)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// udpKeySize is the size, in bytes, of the pre-shared key UDPUnderlay
+// derives its handshake and data AEADs from. Both AES-256-GCM and
+// chacha20poly1305 take a 32 byte key.
+const udpKeySize = 32
+
+// newAEAD builds the cipher.AEAD for a single purpose (handshake or data)
+// out of the underlay's shared key. It never reuses the raw key directly:
+// each purpose gets its own key via a plain SHA-256 derivation, so a
+// handshake ciphertext and a data ciphertext are never encrypted under
+// the same key even though both ultimately come from the same secret.
+func newAEAD(capabilities channelCapability, key []byte, purpose string) (cipher.AEAD, error) {
+	if len(key) != udpKeySize {
+		return nil, fmt.Errorf("newAEAD: key must be %d bytes, got %d", udpKeySize, len(key))
+	}
+	derived := sha256.Sum256(append([]byte(purpose+":"), key...))
+	switch {
+	case capabilities&capCipherAESGCM != 0:
+		block, err := aes.NewCipher(derived[:])
+		if err != nil {
+			return nil, fmt.Errorf("aes.NewCipher() failed: %w", err)
+		}
+		return cipher.NewGCM(block)
+	case capabilities&capCipherChaCha20Poly1305 != 0:
+		return chacha20poly1305.New(derived[:])
+	default:
+		return nil, fmt.Errorf("newAEAD: no supported cipher in capabilities %#x", capabilities)
+	}
+}
+
+// seal encrypts plaintext with a fresh random nonce and returns
+// nonce || ciphertext, so the datagram carries everything open needs.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce failed: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open reverses seal: b is nonce || ciphertext, as produced by seal with
+// the same aead.
+func open(aead cipher.AEAD, b []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(b) < n {
+		return nil, fmt.Errorf("open: ciphertext shorter than nonce size %d", n)
+	}
+	return aead.Open(nil, b[:n], b[n:], nil)
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, udpKeySize)
+	aead, err := newAEAD(capCipherAESGCM, key, "data")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	plaintext := []byte("hello over UDP")
+	sealed, err := seal(aead, plaintext)
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("sealed datagram must not contain the plaintext")
+	}
+	got, err := open(aead, sealed)
+	if err != nil {
+		t.Fatalf("open() failed: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("open() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestSealProducesDistinctCiphertexts(t *testing.T) {
+	key := bytes.Repeat([]byte{0x07}, udpKeySize)
+	aead, err := newAEAD(capCipherAESGCM, key, "handshake")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	plaintext := []byte("same handshake bytes every time")
+	a, err := seal(aead, plaintext)
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	b, err := seal(aead, plaintext)
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("sealing the same plaintext twice should not produce identical ciphertext (random nonce)")
+	}
+}
+
+func TestOpenRejectsTamperedCiphertext(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, udpKeySize)
+	aead, err := newAEAD(capCipherAESGCM, key, "data")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	sealed, err := seal(aead, []byte("segment bytes"))
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 0xFF
+	if _, err := open(aead, sealed); err == nil {
+		t.Fatal("open() should reject a tampered ciphertext")
+	}
+}
+
+func TestOpenRejectsWrongKey(t *testing.T) {
+	key1 := bytes.Repeat([]byte{0x01}, udpKeySize)
+	key2 := bytes.Repeat([]byte{0x02}, udpKeySize)
+	sender, err := newAEAD(capCipherAESGCM, key1, "data")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	receiver, err := newAEAD(capCipherAESGCM, key2, "data")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	sealed, err := seal(sender, []byte("segment bytes"))
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	if _, err := open(receiver, sealed); err == nil {
+		t.Fatal("open() should fail when the receiver derives a different key")
+	}
+}
+
+func TestNewAEADPicksChaChaWhenAESGCMNotOffered(t *testing.T) {
+	key := bytes.Repeat([]byte{0x09}, udpKeySize)
+	aead, err := newAEAD(capCipherChaCha20Poly1305, key, "data")
+	if err != nil {
+		t.Fatalf("newAEAD() failed: %v", err)
+	}
+	plaintext := []byte("chacha path")
+	sealed, err := seal(aead, plaintext)
+	if err != nil {
+		t.Fatalf("seal() failed: %v", err)
+	}
+	got, err := open(aead, sealed)
+	if err != nil {
+		t.Fatalf("open() failed: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("open() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestNewAEADRejectsWrongKeySize(t *testing.T) {
+	if _, err := newAEAD(capCipherAESGCM, []byte("too short"), "data"); err == nil {
+		t.Fatal("newAEAD() should reject a key that isn't udpKeySize bytes")
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import "context"
+
+// defaultTCPMTU is the MTU TCPUnderlay.MTU reports. TCP is a reliable
+// byte stream, so nothing downstream actually relies on this value the
+// way the UDP reliability path relies on UDPUnderlay.MTU(); it exists
+// only so TCPUnderlay satisfies SegmentChannel.
+const defaultTCPMTU = 1500
+
+var _ SegmentChannel = (*TCPUnderlay)(nil)
+
+// WriteSegment implements SegmentChannel over the existing TCP write
+// path. ctx is accepted for interface compatibility; writeOneSegment
+// already carries its own internal framing and isn't context-aware.
+func (t *TCPUnderlay) WriteSegment(ctx context.Context, seg *segment) error {
+	return t.writeOneSegment(seg)
+}
+
+// ReadSegment implements SegmentChannel over the existing TCP read path
+// that fills Session.recvChan.
+func (t *TCPUnderlay) ReadSegment(ctx context.Context, seg *segment) error {
+	return t.readOneSegment(seg)
+}
+
+// MTU and SetMTU exist to satisfy SegmentChannel. Session tracks its own
+// authoritative MTU (Session.mtu, set from the version handshake in
+// AttachUnderlay) rather than deferring to the channel, so SetMTU here is
+// an intentional no-op.
+func (t *TCPUnderlay) MTU() int   { return defaultTCPMTU }
+func (t *TCPUnderlay) SetMTU(int) {}
@@ -0,0 +1,208 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/metrics"
+	"github.com/enfein/mieru/pkg/netutil"
+	"github.com/enfein/mieru/pkg/pool"
+)
+
+// UDPUnderlay is the UDP counterpart to TCPUnderlay: a Session's Underlay
+// backed by a connected UDP socket. Unlike TCP, UDP gives segments no
+// framing or ordering of its own, so UDPUnderlay performs the version
+// handshake itself at construction time and leans on SegmentCodec for
+// every read and write. Every datagram it sends or receives, including
+// the handshake itself, is sealed with an AEAD derived from the shared
+// key passed to NewUDPUnderlay - nothing crosses the wire in the clear.
+type UDPUnderlay struct {
+	conn       *net.UDPConn
+	codec      SegmentCodec
+	ipVersion  netutil.IPVersion
+	negotiated versionHandshake
+	dataAEAD   cipher.AEAD
+
+	mu  sync.Mutex
+	mtu int
+}
+
+var (
+	_ Underlay       = (*UDPUnderlay)(nil)
+	_ SegmentChannel = (*UDPUnderlay)(nil)
+)
+
+// NewUDPUnderlay wraps conn as an Underlay, performing the version
+// handshake with the peer before returning. isClient decides which side
+// speaks first, matching the TCP handshake's client/server roles. key is
+// the pre-shared secret both peers already hold (the same one TCPUnderlay
+// derives its cipher from); NewUDPUnderlay uses it to seal the handshake
+// datagrams and, once a cipher suite is negotiated, every data segment.
+func NewUDPUnderlay(ctx context.Context, conn *net.UDPConn, isClient bool, ipVersion netutil.IPVersion, mtu int, key []byte) (*UDPUnderlay, error) {
+	local := versionHandshake{
+		version:      channelVersion,
+		mtu:          uint32(mtu),
+		capabilities: capSACK | capCipherAESGCM | capCipherChaCha20Poly1305,
+	}
+	handshakeAEAD, err := newAEAD(capCipherAESGCM, key, "handshake")
+	if err != nil {
+		return nil, fmt.Errorf("building handshake cipher failed: %w", err)
+	}
+	remote, err := exchangeUDPHandshake(conn, local, isClient, handshakeAEAD)
+	if err != nil {
+		return nil, fmt.Errorf("version handshake with %v failed: %w", conn.RemoteAddr(), err)
+	}
+	negotiated, err := negotiateHandshake(local, remote)
+	if err != nil {
+		return nil, fmt.Errorf("negotiateHandshake() failed: %w", err)
+	}
+	dataAEAD, err := newAEAD(negotiated.capabilities, key, "data")
+	if err != nil {
+		return nil, fmt.Errorf("building data cipher failed: %w", err)
+	}
+	return &UDPUnderlay{
+		conn:       conn,
+		codec:      defaultSegmentCodec{},
+		ipVersion:  ipVersion,
+		negotiated: negotiated,
+		dataAEAD:   dataAEAD,
+		mtu:        int(negotiated.mtu),
+	}, nil
+}
+
+// Negotiated returns the versionHandshake this underlay agreed on with its
+// peer, so Session.AttachUnderlay can adopt its MTU and capabilities.
+func (u *UDPUnderlay) Negotiated() versionHandshake { return u.negotiated }
+
+func (u *UDPUnderlay) LocalAddr() net.Addr  { return u.conn.LocalAddr() }
+func (u *UDPUnderlay) RemoteAddr() net.Addr { return u.conn.RemoteAddr() }
+
+func (u *UDPUnderlay) IPVersion() netutil.IPVersion { return u.ipVersion }
+
+func (u *UDPUnderlay) TransportProtocol() netutil.TransportProtocol { return netutil.UDPTransport }
+
+func (u *UDPUnderlay) MTU() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.mtu
+}
+
+func (u *UDPUnderlay) SetMTU(mtu int) {
+	u.mu.Lock()
+	u.mtu = mtu
+	u.mu.Unlock()
+}
+
+func (u *UDPUnderlay) WriteSegment(ctx context.Context, seg *segment) error {
+	if dl, ok := ctx.Deadline(); ok {
+		u.conn.SetWriteDeadline(dl)
+	} else {
+		u.conn.SetWriteDeadline(time.Time{})
+	}
+	var buf bytes.Buffer
+	if err := u.codec.Encode(seg, &buf); err != nil {
+		return fmt.Errorf("Encode() failed: %w", err)
+	}
+	sealed, err := seal(u.dataAEAD, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("sealing segment failed: %w", err)
+	}
+	_, err = u.conn.Write(sealed)
+	return err
+}
+
+func (u *UDPUnderlay) ReadSegment(ctx context.Context, seg *segment) error {
+	if dl, ok := ctx.Deadline(); ok {
+		u.conn.SetReadDeadline(dl)
+	} else {
+		u.conn.SetReadDeadline(time.Time{})
+	}
+	b := pool.Get(u.MTU())
+	defer pool.Put(b)
+	n, err := u.conn.Read(b)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(u.dataAEAD, b[:n])
+	if err != nil {
+		metrics.SegmentsDropped.Add(metrics.DropReasonDecryptFail, 1)
+		return fmt.Errorf("opening segment failed: %w", err)
+	}
+	return u.codec.Decode(bytes.NewReader(plaintext), seg)
+}
+
+// handshakeWireSize is the marshaled size of a versionHandshake: version,
+// mtu, and capabilities, each a uint32.
+const handshakeWireSize = 12
+
+func marshalHandshake(h versionHandshake) []byte {
+	buf := make([]byte, handshakeWireSize)
+	binary.BigEndian.PutUint32(buf[0:4], h.version)
+	binary.BigEndian.PutUint32(buf[4:8], h.mtu)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(h.capabilities))
+	return buf
+}
+
+func unmarshalHandshake(buf []byte) versionHandshake {
+	return versionHandshake{
+		version:      binary.BigEndian.Uint32(buf[0:4]),
+		mtu:          binary.BigEndian.Uint32(buf[4:8]),
+		capabilities: channelCapability(binary.BigEndian.Uint32(buf[8:12])),
+	}
+}
+
+// exchangeUDPHandshake performs a single-datagram round trip carrying
+// local's versionHandshake to the peer and the peer's back, with the
+// client writing first so a freshly opened NAT mapping has something to
+// reply to. Both datagrams are sealed with handshakeAEAD: without that,
+// the handshake would be a fixed 12-byte plaintext pattern, trivially
+// fingerprintable on the wire.
+func exchangeUDPHandshake(conn *net.UDPConn, local versionHandshake, isClient bool, handshakeAEAD cipher.AEAD) (versionHandshake, error) {
+	out, err := seal(handshakeAEAD, marshalHandshake(local))
+	if err != nil {
+		return versionHandshake{}, fmt.Errorf("sealing handshake failed: %w", err)
+	}
+	in := make([]byte, handshakeWireSize+handshakeAEAD.NonceSize()+handshakeAEAD.Overhead())
+	var n int
+	if isClient {
+		if _, err := conn.Write(out); err != nil {
+			return versionHandshake{}, err
+		}
+		if n, err = conn.Read(in); err != nil {
+			return versionHandshake{}, err
+		}
+	} else {
+		if n, err = conn.Read(in); err != nil {
+			return versionHandshake{}, err
+		}
+		if _, err := conn.Write(out); err != nil {
+			return versionHandshake{}, err
+		}
+	}
+	plaintext, err := open(handshakeAEAD, in[:n])
+	if err != nil {
+		return versionHandshake{}, fmt.Errorf("opening handshake failed: %w", err)
+	}
+	return unmarshalHandshake(plaintext), nil
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"sync"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/metrics"
+	"github.com/enfein/mieru/pkg/netutil"
+	"github.com/enfein/mieru/pkg/pool"
+)
+
+// writerQueueDepth bounds how many segments of a given priority may be
+// queued for one Underlay. Past it, enqueue drops the oldest queued data
+// segment to make room for a new one, and blocks for every other
+// priority. Modelled on DERP's perClientSendQueueDepth.
+const writerQueueDepth = 256
+
+// segmentPriority orders segments competing for one Underlay's writer
+// goroutine. Lower values are served first.
+type segmentPriority int
+
+const (
+	priorityControl segmentPriority = iota
+	priorityHandshake
+	priorityRetransmission
+	priorityData
+)
+
+// classifyPriority derives a segment's scheduling priority from its
+// protocol. Callers that already know a segment is a retransmission
+// should use priorityRetransmission explicitly instead, since it can't be
+// recovered from the protocol alone.
+func classifyPriority(seg *segment) segmentPriority {
+	switch seg.metadata.Protocol() {
+	case closeSessionRequest, closeSessionResponse, ackClientToServer, ackServerToClient:
+		return priorityControl
+	case openSessionRequest, openSessionResponse:
+		return priorityHandshake
+	default:
+		return priorityData
+	}
+}
+
+// underlayWriter serializes all writes to one Underlay through a single
+// goroutine, fairly scheduling across every Session attached to it.
+// Segments are dispatched in priority order: close/ack control segments,
+// then handshake segments, then retransmissions, then new data. Sessions
+// no longer write to the shared underlay independently. Each Session
+// still drains its own sendQueue in runOutputLoop, and over UDP it polls
+// that queue every segmentPollInterval.
+type underlayWriter struct {
+	underlay Underlay
+
+	// refs counts the Sessions currently attached to underlay, guarded by
+	// underlayWritersMu. It decides when run() should be stopped and the
+	// registry entry removed.
+	refs int
+
+	control   chan *segment
+	handshake chan *segment
+	retrans   chan *segment
+	data      chan *segment
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newUnderlayWriter(u Underlay) *underlayWriter {
+	w := &underlayWriter{
+		underlay:  u,
+		control:   make(chan *segment, writerQueueDepth),
+		handshake: make(chan *segment, writerQueueDepth),
+		retrans:   make(chan *segment, writerQueueDepth),
+		data:      make(chan *segment, writerQueueDepth),
+		done:      make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// enqueue schedules seg to be written with the given priority. Control and
+// handshake segments are never dropped; when the data queue is full, the
+// oldest queued data segment is dropped to make room, since retaining
+// fresh data is more useful to the application than stale data.
+func (w *underlayWriter) enqueue(seg *segment, prio segmentPriority) {
+	switch prio {
+	case priorityControl:
+		w.enqueueOrBlock(w.control, seg)
+		return
+	case priorityHandshake:
+		w.enqueueOrBlock(w.handshake, seg)
+		return
+	case priorityRetransmission:
+		w.enqueueOrBlock(w.retrans, seg)
+		return
+	}
+	for {
+		select {
+		case w.data <- seg:
+			return
+		case <-w.done:
+			metrics.SegmentsDropped.Add(metrics.DropReasonSessionClosed, 1)
+			return
+		default:
+		}
+		select {
+		case <-w.data:
+			metrics.SegmentsDropped.Add(metrics.DropReasonQueueFull, 1)
+			if log.IsLevelEnabled(log.DebugLevel) {
+				log.Debugf("underlayWriter %v dropped a queued data segment under overload", w.underlay)
+			}
+		default:
+		}
+	}
+}
+
+func (w *underlayWriter) enqueueOrBlock(ch chan *segment, seg *segment) {
+	select {
+	case ch <- seg:
+	case <-w.done:
+		metrics.SegmentsDropped.Add(metrics.DropReasonSessionClosed, 1)
+	}
+}
+
+func (w *underlayWriter) stop() {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	w.wg.Wait()
+}
+
+// run dispatches queued segments in strict priority order: control, then
+// handshake, then retransmission, then data. A single flat select can't
+// express that - Go picks pseudo-randomly among whichever cases are ready
+// - so each tier is tried with its own non-blocking select before falling
+// through to the next, and only once nothing at all is ready does run
+// block, on every channel at once, so it wakes as soon as anything
+// arrives.
+func (w *underlayWriter) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case seg := <-w.control:
+			w.write(seg)
+			continue
+		default:
+		}
+		select {
+		case <-w.done:
+			return
+		case seg := <-w.control:
+			w.write(seg)
+			continue
+		case seg := <-w.handshake:
+			w.write(seg)
+			continue
+		default:
+		}
+		select {
+		case <-w.done:
+			return
+		case seg := <-w.control:
+			w.write(seg)
+			continue
+		case seg := <-w.handshake:
+			w.write(seg)
+			continue
+		case seg := <-w.retrans:
+			w.write(seg)
+			continue
+		default:
+		}
+		select {
+		case <-w.done:
+			return
+		case seg := <-w.control:
+			w.write(seg)
+		case seg := <-w.handshake:
+			w.write(seg)
+		case seg := <-w.retrans:
+			w.write(seg)
+		case seg := <-w.data:
+			w.write(seg)
+		}
+	}
+}
+
+func (w *underlayWriter) write(seg *segment) {
+	ch, ok := w.underlay.(SegmentChannel)
+	if !ok {
+		log.Debugf("underlayWriter %v write failed: underlay %T does not implement SegmentChannel", w.underlay, w.underlay)
+		return
+	}
+	err := ch.WriteSegment(context.Background(), seg)
+	if err != nil {
+		log.Debugf("underlayWriter %v write failed: %v", w.underlay, err)
+	} else {
+		metrics.SegmentsSent.Add(1)
+	}
+	// Over TCP, a segment is never retained for retransmission, so its
+	// pooled payload can be released as soon as it's on the wire. Over
+	// UDP, the segment may still live in sendBuf; ownership of its
+	// payload returns to the pool later, when it's finally acked.
+	if w.underlay.TransportProtocol() == netutil.TCPTransport {
+		pool.Put(seg.payload)
+	}
+}
+
+// underlayWriters holds the single writer goroutine for each Underlay that
+// currently has at least one Session attached to it.
+var (
+	underlayWritersMu sync.Mutex
+	underlayWriters   = make(map[Underlay]*underlayWriter)
+)
+
+// getUnderlayWriter returns the shared writer for u. Every Session
+// enqueuing onto u is expected to have already called
+// acquireUnderlayWriter via Session.AttachUnderlay, so this only creates
+// an entry as a defensive fallback; it does not affect refs.
+func getUnderlayWriter(u Underlay) *underlayWriter {
+	underlayWritersMu.Lock()
+	defer underlayWritersMu.Unlock()
+	if w, ok := underlayWriters[u]; ok {
+		return w
+	}
+	w := newUnderlayWriter(u)
+	underlayWriters[u] = w
+	return w
+}
+
+// acquireUnderlayWriter returns the shared writer for u, creating it if
+// this is the first Session attaching to u, and increments its reference
+// count. Every call must be matched by a releaseUnderlayWriter once the
+// attaching Session is done with u, typically from Session.cleanup.
+func acquireUnderlayWriter(u Underlay) *underlayWriter {
+	underlayWritersMu.Lock()
+	defer underlayWritersMu.Unlock()
+	w, ok := underlayWriters[u]
+	if !ok {
+		w = newUnderlayWriter(u)
+		underlayWriters[u] = w
+	}
+	w.refs++
+	return w
+}
+
+// releaseUnderlayWriter drops one reference to u's writer. Once the last
+// Session attached to u releases it, the writer goroutine is stopped and
+// the registry entry removed, so a closed connection doesn't leak a
+// goroutine and four channels forever.
+func releaseUnderlayWriter(u Underlay) {
+	underlayWritersMu.Lock()
+	w, ok := underlayWriters[u]
+	if !ok {
+		underlayWritersMu.Unlock()
+		return
+	}
+	w.refs--
+	if w.refs > 0 {
+		underlayWritersMu.Unlock()
+		return
+	}
+	delete(underlayWriters, u)
+	underlayWritersMu.Unlock()
+	w.stop()
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/netutil"
+)
+
+// fakeUnderlay is a minimal Underlay + SegmentChannel double that records
+// every segment handed to WriteSegment, in order, instead of touching a
+// real socket. It exists purely for unit testing underlayWriter.
+type fakeUnderlay struct {
+	transport netutil.TransportProtocol
+
+	mu      sync.Mutex
+	written []*segment
+}
+
+func (f *fakeUnderlay) LocalAddr() net.Addr                          { return &net.UDPAddr{} }
+func (f *fakeUnderlay) RemoteAddr() net.Addr                         { return &net.UDPAddr{} }
+func (f *fakeUnderlay) IPVersion() netutil.IPVersion                 { return netutil.IPVersion(0) }
+func (f *fakeUnderlay) TransportProtocol() netutil.TransportProtocol { return f.transport }
+func (f *fakeUnderlay) MTU() int                                     { return 1400 }
+func (f *fakeUnderlay) SetMTU(int)                                   {}
+
+func (f *fakeUnderlay) WriteSegment(ctx context.Context, seg *segment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, seg)
+	return nil
+}
+
+func (f *fakeUnderlay) ReadSegment(ctx context.Context, seg *segment) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeUnderlay) snapshot() []*segment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]*segment, len(f.written))
+	copy(out, f.written)
+	return out
+}
+
+func controlSegment(protocol uint8) *segment {
+	return &segment{metadata: &ackStruct{baseStruct: baseStruct{protocol: protocol}}}
+}
+
+// TestUnderlayWriterPriorityOrder would have caught a run() implementation
+// that read from all four channels with a single flat select: Go picks
+// pseudo-randomly among ready cases, so without the tiered non-blocking
+// selects a data segment queued before a control segment could jump ahead
+// of it.
+func TestUnderlayWriterPriorityOrder(t *testing.T) {
+	u := &fakeUnderlay{transport: netutil.UDPTransport}
+	// Built without starting run(), so all four segments are already
+	// queued by the time the writer goroutine looks at them; a live
+	// writer would write the data segment the moment it arrived.
+	w := &underlayWriter{
+		underlay:  u,
+		control:   make(chan *segment, writerQueueDepth),
+		handshake: make(chan *segment, writerQueueDepth),
+		retrans:   make(chan *segment, writerQueueDepth),
+		data:      make(chan *segment, writerQueueDepth),
+		done:      make(chan struct{}),
+	}
+	defer w.stop()
+
+	// Queue lowest priority first, highest last, then start the writer:
+	// whichever order they were enqueued in, they must drain in priority
+	// order.
+	data := dataSegment(1)
+	retrans := dataSegment(2)
+	handshake := controlSegment(openSessionRequest)
+	control := controlSegment(ackClientToServer)
+
+	w.enqueue(data, priorityData)
+	w.enqueue(retrans, priorityRetransmission)
+	w.enqueue(handshake, priorityHandshake)
+	w.enqueue(control, priorityControl)
+
+	w.wg.Add(1)
+	go w.run()
+
+	deadline := time.After(time.Second)
+	for {
+		if len(u.snapshot()) == 4 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("writer only wrote %d of 4 segments before timing out", len(u.snapshot()))
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	got := u.snapshot()
+	want := []*segment{control, handshake, retrans, data}
+	for i, seg := range want {
+		if got[i] != seg {
+			t.Errorf("write order[%d] = %p, want %p (control, handshake, retrans, data)", i, got[i], seg)
+		}
+	}
+}
+
+// TestUnderlayWriterDropsOldestDataUnderOverload would have caught enqueue
+// blocking forever (or dropping a control segment) once the data channel
+// filled up, instead of dropping the oldest queued data segment. The
+// writer is built directly, without starting run(), so the data channel
+// fills up instead of draining, letting the overload path be observed
+// deterministically.
+func TestUnderlayWriterDropsOldestDataUnderOverload(t *testing.T) {
+	u := &fakeUnderlay{transport: netutil.UDPTransport}
+	w := &underlayWriter{
+		underlay:  u,
+		control:   make(chan *segment, writerQueueDepth),
+		handshake: make(chan *segment, writerQueueDepth),
+		retrans:   make(chan *segment, writerQueueDepth),
+		data:      make(chan *segment, writerQueueDepth),
+		done:      make(chan struct{}),
+	}
+
+	segs := make([]*segment, writerQueueDepth)
+	for i := range segs {
+		segs[i] = dataSegment(uint32(i))
+		w.data <- segs[i]
+	}
+	if got := len(w.data); got != writerQueueDepth {
+		t.Fatalf("data channel has %d segments queued, want %d", got, writerQueueDepth)
+	}
+
+	extra := dataSegment(uint32(len(segs)))
+	w.enqueue(extra, priorityData)
+
+	if got := len(w.data); got != writerQueueDepth {
+		t.Fatalf("data channel has %d segments queued after overload, want still %d", got, writerQueueDepth)
+	}
+	for i := 0; i < writerQueueDepth; i++ {
+		if <-w.data == segs[0] {
+			t.Fatal("oldest queued data segment should have been dropped to make room for the new one")
+		}
+	}
+}